@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+func (a *app) serveAccount(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "POST" {
+		err := a.postAccount(user, r)
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+		return
+	}
+
+	groups, err := selectDepartmentPlaces(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	regions, err := models.SelectRegions(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	subs, err := models.SelectUserSubscriptions(r.Context(), user.PK)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	channels, err := models.SelectChannelsWhereUserPK(r.Context(), user.PK)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	hours := make([]int, 24)
+	for i := range hours {
+		hours[i] = i
+	}
+	data := struct {
+		User                  models.User
+		Regions               []models.Region
+		Groups                []departmentPlaces
+		Subscribed            map[int]bool
+		SubscribedDepartments map[int]bool
+		SubscribedRegions     map[int]bool
+		Channels              []models.Channel
+		Hours                 []int
+	}{user, regions, groups, intSet(subs.PlacePKs), intSet(subs.DepartmentPKs), intSet(subs.RegionPKs), channels, hours}
+	t := template.Must(template.ParseFiles("template.account.html"))
+	err = t.Execute(w, data)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+func (a *app) postAccount(user models.User, r *http.Request) error {
+	switch r.FormValue("action") {
+	case "add", "delete":
+		placePK, err := strconv.Atoi(r.FormValue("placePK"))
+		if err != nil {
+			return err
+		}
+		if r.FormValue("action") == "add" {
+			return models.InsertUserPlace(r.Context(), user.PK, placePK)
+		}
+		return models.DeleteUserPlace(r.Context(), user.PK, placePK)
+	case "addDepartment", "deleteDepartment":
+		dptPK, err := strconv.Atoi(r.FormValue("departmentPK"))
+		if err != nil {
+			return err
+		}
+		if r.FormValue("action") == "addDepartment" {
+			return models.InsertUserDepartment(r.Context(), user.PK, dptPK)
+		}
+		return models.DeleteUserDepartment(r.Context(), user.PK, dptPK)
+	case "addRegion", "deleteRegion":
+		regionPK, err := strconv.Atoi(r.FormValue("regionPK"))
+		if err != nil {
+			return err
+		}
+		if r.FormValue("action") == "addRegion" {
+			return models.InsertUserRegion(r.Context(), user.PK, regionPK)
+		}
+		return models.DeleteUserRegion(r.Context(), user.PK, regionPK)
+	case "addChannel":
+		ch := models.Channel{UserPK: user.PK, Kind: r.FormValue("kind"), Target: strings.TrimSpace(r.FormValue("target"))}
+		if ch.Kind == models.ChannelEmail {
+			// Other addresses would need their own confirmation.
+			ch.Target = user.Email
+		}
+		err := a.validateChannel(ch)
+		if err != nil {
+			return err
+		}
+		return models.InsertChannel(r.Context(), ch)
+	case "deleteChannel":
+		pk, err := strconv.Atoi(r.FormValue("channelPK"))
+		if err != nil {
+			return err
+		}
+		return models.DeleteChannel(r.Context(), user.PK, pk)
+	case "frequency":
+		switch f := r.FormValue("frequency"); f {
+		case models.FrequencyImmediate, models.FrequencyHourly, models.FrequencyDaily:
+			return models.UpdateUserFrequency(r.Context(), user.PK, f)
+		}
+		return fmt.Errorf("postAccount: unknown frequency %q", r.FormValue("frequency"))
+	case "dealsOnly":
+		dealsOnly, err := strconv.ParseBool(r.FormValue("dealsOnly"))
+		if err != nil {
+			return fmt.Errorf("postAccount: invalid dealsOnly %q", r.FormValue("dealsOnly"))
+		}
+		return models.UpdateUserDealsOnly(r.Context(), user.PK, dealsOnly)
+	case "schedule":
+		timezone := r.FormValue("timezone")
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "" || timezone == "Local" {
+			return fmt.Errorf("postAccount: unknown timezone %q", timezone)
+		}
+		quietStart, err := strconv.Atoi(r.FormValue("quietStart"))
+		if err != nil || quietStart < 0 || quietStart > 23 {
+			return fmt.Errorf("postAccount: invalid quiet hours start %q", r.FormValue("quietStart"))
+		}
+		quietEnd, err := strconv.Atoi(r.FormValue("quietEnd"))
+		if err != nil || quietEnd < 0 || quietEnd > 23 {
+			return fmt.Errorf("postAccount: invalid quiet hours end %q", r.FormValue("quietEnd"))
+		}
+		return models.UpdateUserSchedule(r.Context(), user.PK, timezone, quietStart, quietEnd)
+	case "pause":
+		return models.UnsubscribeUser(r.Context(), user.PK)
+	case "resume":
+		return models.UpdateUserActive(r.Context(), user.PK, true)
+	}
+	return fmt.Errorf("postAccount: unknown action %q", r.FormValue("action"))
+}
+
+func intSet(ints []int) map[int]bool {
+	set := make(map[int]bool)
+	for _, i := range ints {
+		set[i] = true
+	}
+	return set
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+func TestPostAccountReschedules(t *testing.T) {
+	digestSent := time.Now().Add(-30 * time.Minute).Truncate(time.Second)
+	for _, tt := range []struct {
+		form url.Values
+		user []driver.Value
+		want time.Time
+	}{
+		{url.Values{"action": {"frequency"}, "frequency": {models.FrequencyDaily}},
+			[]driver.Value{int64(1), "bob@example.com", true, models.FrequencyDaily, digestSent, "Europe/Paris", int64(0), int64(0), false},
+			digestSent.Add(24 * time.Hour)},
+		{url.Values{"action": {"schedule"}, "timezone": {"UTC"}, "quietStart": {"0"}, "quietEnd": {"0"}},
+			[]driver.Value{int64(1), "bob@example.com", true, models.FrequencyHourly, digestSent, "UTC", int64(0), int64(0), false},
+			digestSent.Add(time.Hour)},
+	} {
+		fake := useFakeDB(t, tt.user)
+		r := httptest.NewRequest("POST", "/account", strings.NewReader(tt.form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		err := newTestApp(t).postAccount(models.User{PK: 1}, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.queries) != 2 || !strings.Contains(fake.queries[1], "UPDATE pollbc_outbox SET") {
+			t.Fatalf("%s: got queries %q, want the outbox rescheduled", tt.form.Get("action"), fake.queries)
+		}
+		got, _ := fake.args[1][1].Value.(time.Time)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got deliver_after %v, want %v", tt.form.Get("action"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+const (
+	apiDefaultLimit = 35
+	apiMaxLimit     = 100
+)
+
+type apiAnnounce struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title"`
+	Price      string    `json:"price"`
+	PriceValue *int      `json:"price_value"`
+	Date       time.Time `json:"date"`
+	Fetched    time.Time `json:"fetched"`
+	PlaceID    int       `json:"place_id"`
+	// MarketPrice is the median price around the announce when it was
+	// fetched.
+	MarketPrice *int `json:"market_price"`
+	BelowMarket bool `json:"below_market"`
+	// Surface is in square meters, the share of one tenant for
+	// colocations. RentCap is the maximum legal rent for it, charges
+	// excluded, in Paris. Rent is the price without the charges, when the
+	// title tells them.
+	Surface *int `json:"surface"`
+	RentCap *int `json:"rent_cap"`
+	Rent    *int `json:"rent"`
+}
+
+func newAPIAnnounce(ann models.Announce) apiAnnounce {
+	a := apiAnnounce{
+		ID:          ann.PK,
+		URL:         ann.URL,
+		Title:       ann.Title,
+		Price:       ann.Price,
+		Date:        ann.Date,
+		Fetched:     ann.Fetched,
+		PlaceID:     ann.PlacePK,
+		BelowMarket: ann.BelowMarket,
+	}
+	if ann.PriceValue != 0 {
+		a.PriceValue = &ann.PriceValue
+	}
+	if ann.MarketPrice != 0 {
+		a.MarketPrice = &ann.MarketPrice
+	}
+	if ann.Surface != 0 {
+		a.Surface = &ann.Surface
+	}
+	if ann.RentCap != 0 {
+		a.RentCap = &ann.RentCap
+	}
+	if ann.Rent != 0 {
+		a.Rent = &ann.Rent
+	}
+	return a
+}
+
+// handleAPI registers the handlers of the API on mux.
+func (a *app) handleAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/announces", a.serveAPIAnnounces)
+	mux.HandleFunc("GET /api/v1/announces/{pk}", serveAPIAnnounce)
+	mux.HandleFunc("GET /api/v1/places", serveAPIPlaces)
+	mux.HandleFunc("GET /api/v1/departments", serveAPIDepartments)
+	mux.HandleFunc("GET /api/v1/stats", a.serveAPIStats)
+	mux.HandleFunc("/api/", serveAPINotFound)
+}
+
+// serveAPIAnnounces lists announces. It accepts the parameters of the index
+// page, and priceMin, priceMax and limit. The cursor of the next page is
+// returned as next_cursor.
+func (a *app) serveAPIAnnounces(w http.ResponseWriter, r *http.Request) {
+	f, err := announceFilter(r, a.cfg.Location)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = apiFilter(&f, r.URL.Query())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	announces, err := models.SelectAnnouncesFilter(r.Context(), f)
+	if err != nil {
+		logRequestError(r, err)
+		apiError(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	resp := struct {
+		Announces  []apiAnnounce `json:"announces"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{Announces: []apiAnnounce{}}
+	for _, ann := range announces {
+		resp.Announces = append(resp.Announces, newAPIAnnounce(ann))
+	}
+	if len(announces) == f.Limit {
+		resp.NextCursor = encodeCursor(f.CursorOf(announces[len(announces)-1]))
+	}
+	apiJSON(w, http.StatusOK, resp)
+}
+
+// apiFilter reads the parameters of the API that the index page lacks.
+func apiFilter(f *models.AnnounceFilter, q url.Values) error {
+	var err error
+	if v := q.Get("priceMin"); v != "" {
+		f.PriceMin, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid priceMin %q", v)
+		}
+	}
+	if v := q.Get("priceMax"); v != "" {
+		f.PriceMax, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid priceMax %q", v)
+		}
+	}
+	f.Limit = apiDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 1 || f.Limit > apiMaxLimit {
+			return fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+	}
+	return nil
+}
+
+func serveAPIAnnounce(w http.ResponseWriter, r *http.Request) {
+	pk, err := strconv.Atoi(r.PathValue("pk"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, nil)
+		return
+	}
+	ann, err := models.SelectAnnounceWherePK(r.Context(), pk)
+	if err == sql.ErrNoRows {
+		apiError(w, http.StatusNotFound, nil)
+		return
+	} else if err != nil {
+		logRequestError(r, err)
+		apiError(w, http.StatusInternalServerError, nil)
+		return
+	}
+	apiJSON(w, http.StatusOK, newAPIAnnounce(ann))
+}
+
+func serveAPIPlaces(w http.ResponseWriter, r *http.Request) {
+	places, err := models.SelectPlacesCount(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		apiError(w, http.StatusInternalServerError, nil)
+		return
+	}
+	type place struct {
+		ID             int    `json:"id"`
+		City           string `json:"city,omitempty"`
+		Arrondissement string `json:"arrondissement,omitempty"`
+		DepartmentID   int    `json:"department_id"`
+		Announces      int    `json:"announces"`
+	}
+	resp := struct {
+		Places []place `json:"places"`
+	}{[]place{}}
+	for _, p := range places {
+		resp.Places = append(resp.Places, place{p.PK, p.City, p.Arrondissement, p.DepartmentPK, p.Announces})
+	}
+	apiJSON(w, http.StatusOK, resp)
+}
+
+func serveAPIDepartments(w http.ResponseWriter, r *http.Request) {
+	dpts, err := models.SelectDepartmentsCount(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		apiError(w, http.StatusInternalServerError, nil)
+		return
+	}
+	type department struct {
+		ID        int    `json:"id"`
+		Name      string `json:"name"`
+		RegionID  int    `json:"region_id,omitempty"`
+		Announces int    `json:"announces"`
+	}
+	resp := struct {
+		Departments []department `json:"departments"`
+	}{[]department{}}
+	for _, d := range dpts {
+		resp.Departments = append(resp.Departments, department{d.PK, d.Name, d.RegionPK, d.Announces})
+	}
+	apiJSON(w, http.StatusOK, resp)
+}
+
+func serveAPINotFound(w http.ResponseWriter, r *http.Request) {
+	apiError(w, http.StatusNotFound, nil)
+}
+
+// apiError writes an error as {"error": {"status": 400, "message": "..."}}.
+// The message defaults to the status text.
+func apiError(w http.ResponseWriter, status int, err error) {
+	message := http.StatusText(status)
+	if err != nil {
+		message = err.Error()
+	}
+	type apiErr struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	}
+	apiJSON(w, status, struct {
+		Error apiErr `json:"error"`
+	}{apiErr{status, message}})
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("writing response", "err", err)
+	}
+}
+
+type apiPriceStats struct {
+	Count  int     `json:"count"`
+	Q1     float64 `json:"q1"`
+	Median float64 `json:"median"`
+	Q3     float64 `json:"q3"`
+}
+
+func newAPIPriceStats(s models.PriceStats) *apiPriceStats {
+	if s.Prices == 0 {
+		return nil
+	}
+	return &apiPriceStats{s.Prices, s.Q1, s.Median, s.Q3}
+}
+
+// serveAPIStats returns the stats of the /stats page. It accepts its
+// placePK, departmentPK, from and to parameters.
+func (a *app) serveAPIStats(w http.ResponseWriter, r *http.Request) {
+	f, err := statsFilter(r, a.cfg.Location)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	stats, err := selectMarketStats(r.Context(), f)
+	if err != nil {
+		logRequestError(r, err)
+		apiError(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	type day struct {
+		Day       string         `json:"day"`
+		Announces int            `json:"announces"`
+		Price     *apiPriceStats `json:"price"`
+	}
+	type group struct {
+		ID        int            `json:"id"`
+		Announces int            `json:"announces"`
+		Price     *apiPriceStats `json:"price"`
+	}
+	resp := struct {
+		Days        []day   `json:"days"`
+		Departments []group `json:"departments"`
+		Places      []group `json:"places"`
+		// Weekdays start on Sunday.
+		Weekdays [7]int  `json:"weekdays"`
+		Hours    [24]int `json:"hours"`
+	}{
+		Days:        []day{},
+		Departments: []group{},
+		Places:      []group{},
+		Weekdays:    stats.Posting.Weekdays,
+		Hours:       stats.Posting.Hours,
+	}
+	for _, d := range stats.Days {
+		resp.Days = append(resp.Days, day{d.Day.Format("2006-01-02"), d.Announces, newAPIPriceStats(d.PriceStats)})
+	}
+	for _, d := range stats.Departments {
+		resp.Departments = append(resp.Departments, group{d.DepartmentPK, d.Announces, newAPIPriceStats(d.PriceStats)})
+	}
+	for _, p := range stats.Places {
+		resp.Places = append(resp.Places, group{p.PlacePK, p.Announces, newAPIPriceStats(p.PriceStats)})
+	}
+	apiJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/config"
+	"github.com/yansal/pollbc/models"
+)
+
+// fakeDB is a database/sql driver that answers every query with rows, or
+// fails with err. answer, if set, answers the queries instead of rows.
+// Statements that are not queries affect the number of rows affected.
+type fakeDB struct {
+	rows     [][]driver.Value
+	err      error
+	answer   func(query string, args []driver.NamedValue) [][]driver.Value
+	affected int64
+	queries  []string
+	args     [][]driver.NamedValue
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return fakeTx{}, nil }
+
+// fakeTx is a transaction that does nothing, since fakeDB has no state.
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.queries = append(c.db.queries, query)
+	c.db.args = append(c.db.args, args)
+	if c.db.err != nil {
+		return nil, c.db.err
+	}
+	if c.db.answer != nil {
+		return &fakeRows{rows: c.db.answer(query, args)}, nil
+	}
+	return &fakeRows{rows: c.db.rows}, nil
+}
+
+func (c fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.queries = append(c.db.queries, query)
+	c.db.args = append(c.db.args, args)
+	if c.db.err != nil {
+		return nil, c.db.err
+	}
+	return driver.RowsAffected(c.db.affected), nil
+}
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return make([]string, 13)
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// useFakeDB makes the models query a fakeDB answering rows.
+func useFakeDB(t *testing.T, rows ...[]driver.Value) *fakeDB {
+	fake := &fakeDB{rows: rows}
+	d := sql.OpenDB(fake)
+	models.OpenDB(d)
+	t.Cleanup(func() { d.Close() })
+	return fake
+}
+
+// newTestApp returns an app with the default configuration.
+func newTestApp(t *testing.T) *app {
+	cfg := config.Default()
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &app{cfg: cfg}
+}
+
+// announceRow returns a row of announceColumns.
+func announceRow(pk int64, date time.Time) []driver.Value {
+	return []driver.Value{pk, "http://www.leboncoin.fr/locations/1.htm", date, "900 €", "Studio", date,
+		int64(75111), int64(900), int64(0), false, int64(20), int64(700), int64(0)}
+}
+
+func serveAPI(t *testing.T, target string) (*http.Response, map[string]interface{}) {
+	mux := http.NewServeMux()
+	newTestApp(t).handleAPI(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	resp := rec.Result()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("%s: got Content-Type %q", target, ct)
+	}
+	var body map[string]interface{}
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		t.Fatalf("%s: %v", target, err)
+	}
+	return resp, body
+}
+
+func TestAPIAnnounces(t *testing.T) {
+	date := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeDB(t, announceRow(2, date), announceRow(1, date.Add(-time.Hour)))
+
+	resp, body := serveAPI(t, "/api/v1/announces?limit=2&priceMax=1000")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %v", resp.Status, body)
+	}
+	announces := body["announces"].([]interface{})
+	if len(announces) != 2 {
+		t.Fatalf("got %d announces", len(announces))
+	}
+	first := announces[0].(map[string]interface{})
+	for key, want := range map[string]interface{}{
+		"id": 2.0, "title": "Studio", "price_value": 900.0, "market_price": nil,
+		"surface": 20.0, "rent_cap": 700.0, "date": "2016-05-01T12:00:00Z",
+	} {
+		if first[key] != want {
+			t.Errorf("got %s %v, want %v", key, first[key], want)
+		}
+	}
+	args := fake.args[0]
+	if limit := args[len(args)-1].Value; limit != int64(2) {
+		t.Errorf("got limit %v, want 2", limit)
+	}
+
+	// A full page has a cursor to the next one.
+	cursor, ok := body["next_cursor"].(string)
+	if !ok {
+		t.Fatal("got no next_cursor")
+	}
+	c, err := decodeCursor(cursor)
+	if err != nil || c.PK != 1 {
+		t.Errorf("got cursor %+v, %v", c, err)
+	}
+	fake.rows = [][]driver.Value{announceRow(0, date.Add(-2*time.Hour))}
+	resp, body = serveAPI(t, "/api/v1/announces?limit=2&cursor="+cursor)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %v", resp.Status, body)
+	}
+	if _, ok := body["next_cursor"]; ok {
+		t.Error("got a next_cursor after the last page")
+	}
+}
+
+func TestAPIAnnouncesBadRequest(t *testing.T) {
+	fake := useFakeDB(t)
+	for _, target := range []string{
+		"/api/v1/announces?cursor=not-a-cursor",
+		"/api/v1/announces?limit=0",
+		"/api/v1/announces?limit=1000",
+		"/api/v1/announces?priceMin=cheap",
+		"/api/v1/announces?placePK=x",
+	} {
+		resp, body := serveAPI(t, target)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %s", target, resp.Status)
+		}
+		apiErr, _ := body["error"].(map[string]interface{})
+		if apiErr["status"] != 400.0 || apiErr["message"] == "" {
+			t.Errorf("%s: got %v", target, body)
+		}
+	}
+	if len(fake.queries) != 0 {
+		t.Errorf("bad requests queried the database %d times", len(fake.queries))
+	}
+}
+
+func TestAPIAnnounce(t *testing.T) {
+	date := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeDB(t, announceRow(42, date))
+	resp, body := serveAPI(t, "/api/v1/announces/42")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s: %v", resp.Status, body)
+	}
+	if body["id"] != 42.0 || body["url"] != "http://www.leboncoin.fr/locations/1.htm" {
+		t.Errorf("got %v", body)
+	}
+	if pk := fake.args[0][0].Value; pk != int64(42) {
+		t.Errorf("queried pk %v", pk)
+	}
+}
+
+func TestAPINotFound(t *testing.T) {
+	useFakeDB(t)
+	for _, target := range []string{
+		// The fake database has no announce.
+		"/api/v1/announces/42",
+		"/api/v1/announces/abc",
+		"/api/",
+		"/api/v2/announces",
+		"/api/v1/unknown",
+	} {
+		resp, body := serveAPI(t, target)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got %s", target, resp.Status)
+		}
+		want := map[string]interface{}{"status": 404.0, "message": "Not Found"}
+		apiErr, _ := body["error"].(map[string]interface{})
+		if len(apiErr) != 2 || apiErr["status"] != want["status"] || apiErr["message"] != want["message"] {
+			t.Errorf("%s: got %v", target, body)
+		}
+	}
+}
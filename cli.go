@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yansal/pollbc/config"
+	"github.com/yansal/pollbc/models"
+)
+
+// commands are the subcommands of pollbc. They share the configuration
+// flags, file and environment of serve.
+var commands = map[string]func(args []string) error{
+	"serve":   serve,
+	"poll":    pollCommand,
+	"migrate": migrateCommand,
+	"users":   usersCommand,
+	"sources": sourcesCommand,
+	"notify":  notifyCommand,
+}
+
+const usage = `usage: pollbc [command] [flags] [args]
+
+commands:
+  serve [-roles roles]                 run the roles of the process (default)
+  poll [-once]                         poll the sources, or print their announces once
+  migrate                              create the missing tables and columns
+  users list                           list the users and their subscriptions
+  users add [-place name]... email     add an active user
+  users remove email                   remove a user
+  sources list                         list the sources
+  sources add name url                 add a source
+  sources remove name                  remove a source
+  sources test name|url                fetch a source and print its announces
+  notify -resend -user email [-since duration | -from date [-to date]]
+                                       notify a user again of the announces of a time window
+
+Run pollbc command -h for the flags of a command.
+`
+
+func main() {
+	name, args := "serve", os.Args[1:]
+	// pollbc without a command, or with flags only, serves.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	err := cmd(args)
+	if err != nil {
+		fatal(name+" failed", "err", err)
+	}
+}
+
+// setup parses the flags of a command, including the configuration flags,
+// loads the configuration and checks that the settings required by the
+// command are set. It returns the configuration.
+func setup(fs *flag.FlagSet, args []string, required ...string) (*config.Config, error) {
+	loader := config.NewLoader(fs)
+	fs.Parse(args)
+	cfg, err := loader.Load()
+	if err == nil {
+		err = cfg.Require(append(required, "database_url")...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	setupLogging(cfg.Log)
+	return cfg, nil
+}
+
+// checkArgs checks that fs parsed n arguments, before the command touches
+// the database. The flags after the arguments aren't parsed, so they are
+// unexpected arguments.
+func checkArgs(fs *flag.FlagSet, n int, usage string) error {
+	switch {
+	case fs.NArg() > n:
+		return fmt.Errorf("unexpected arguments %q, flags go before the arguments (usage: %s)", fs.Args()[n:], usage)
+	case fs.NArg() < n:
+		return errors.New("usage: " + usage)
+	}
+	return nil
+}
+
+// openDatabase connects to the database and migrates it, so that commands
+// never run against missing tables or columns.
+func openDatabase(cfg *config.Config) error {
+	err := models.Open(cfg.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("connecting to the database: %w", err)
+	}
+	err = models.Migrate(cfg.Location)
+	if err != nil {
+		models.Close()
+		return fmt.Errorf("migrating: %w", err)
+	}
+	return nil
+}
+
+// signalContext returns a context that is done on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// drainContext returns a context that is not done with ctx, but grace
+// after it, so that the work in progress when ctx is done can finish within
+// the shutdown timeout.
+func drainContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(grace, cancel)
+		context.AfterFunc(work, func() { timer.Stop() })
+	})
+	return work, func() {
+		stop()
+		cancel()
+	}
+}
+
+// pollCommand polls the sources until SIGINT or SIGTERM like serve does,
+// or fetches them once and prints their announces without storing them.
+func pollCommand(args []string) error {
+	fs := flag.NewFlagSet("pollbc poll", flag.ExitOnError)
+	once := fs.Bool("once", false, "fetch, parse and print the announces of the sources once, without storing them or notifying")
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 0, "pollbc poll [-once]")
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	a := &app{cfg: cfg}
+	err = setupRentControl(cfg.RentControlFile)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+
+	if !*once {
+		a.poll(ctx)
+		return nil
+	}
+	srcs, err := a.sources(ctx)
+	if err != nil {
+		return err
+	}
+	for _, src := range srcs {
+		err := a.testSource(ctx, os.Stdout, src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testSource fetches src and prints its announces to w.
+func (a *app) testSource(ctx context.Context, w io.Writer, src models.Source) error {
+	parsed, err := a.fetchAnnounces(ctx, slog.Default(), src)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %w", src.URL, err)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tDATE\tPRICE\tPLACE\tTITLE\tURL")
+	for _, p := range parsed {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", src.Name, p.Date.Format("2006-01-02 15:04"), p.Price,
+			formatPlace(p.Place, p.Department), p.Title, p.URL)
+	}
+	return tw.Flush()
+}
+
+func migrateCommand(args []string) error {
+	fs := flag.NewFlagSet("pollbc migrate", flag.ExitOnError)
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 0, "pollbc migrate")
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	fmt.Println("database is up to date")
+	return nil
+}
+
+func usersCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing users command: list, add or remove")
+	}
+	switch args[0] {
+	case "list":
+		return usersList(args[1:])
+	case "add":
+		return usersAdd(args[1:])
+	case "remove":
+		return usersRemove(args[1:])
+	}
+	return fmt.Errorf("unknown users command %q", args[0])
+}
+
+func usersList(args []string) error {
+	fs := flag.NewFlagSet("pollbc users list", flag.ExitOnError)
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 0, "pollbc users list")
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	ctx := context.Background()
+	names, err := selectPlaceNames(ctx)
+	if err != nil {
+		return err
+	}
+	users, err := models.SelectAllUsers(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tACTIVE\tFREQUENCY\tCHANNELS\tSUBSCRIPTIONS")
+	for _, user := range users {
+		channels, err := models.SelectChannelsWhereUserPK(ctx, user.PK)
+		if err != nil {
+			return err
+		}
+		var kinds []string
+		for _, ch := range channels {
+			kinds = append(kinds, ch.Kind)
+		}
+		subs, err := models.SelectUserSubscriptions(ctx, user.PK)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", user.Email, user.Active, user.Frequency,
+			strings.Join(kinds, ", "), strings.Join(names.of(subs), ", "))
+	}
+	return tw.Flush()
+}
+
+// usersAdd adds an active user notified by email. Unlike the signup form,
+// it doesn't ask the user to confirm.
+func usersAdd(args []string) error {
+	fs := flag.NewFlagSet("pollbc users add", flag.ExitOnError)
+	var places, dpts, regions stringsFlag
+	fs.Var(&places, "place", "subscribe to a place, by name as in users list or by pk (repeatable)")
+	fs.Var(&dpts, "department", "subscribe to a department, by name or pk (repeatable)")
+	fs.Var(&regions, "region", "subscribe to a region, by name or pk (repeatable)")
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 1, "pollbc users add [-place name]... [-department name]... [-region name]... email")
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	ctx := context.Background()
+	email := fs.Arg(0)
+
+	names, err := selectPlaceNames(ctx)
+	if err != nil {
+		return err
+	}
+	var subs models.Subscriptions
+	subs.PlacePKs, err = names.resolve("place", names.places, places)
+	if err != nil {
+		return err
+	}
+	subs.DepartmentPKs, err = names.resolve("department", names.departments, dpts)
+	if err != nil {
+		return err
+	}
+	subs.RegionPKs, err = names.resolve("region", names.regions, regions)
+	if err != nil {
+		return err
+	}
+
+	_, err = models.SelectUserWhereEmail(ctx, email)
+	if err == nil {
+		return fmt.Errorf("user %s already exists", email)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = models.InsertActiveUser(ctx, email, subs)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s\n", email)
+	return nil
+}
+
+func usersRemove(args []string) error {
+	fs := flag.NewFlagSet("pollbc users remove", flag.ExitOnError)
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 1, "pollbc users remove email")
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	ctx := context.Background()
+	user, err := models.SelectUserWhereEmail(ctx, fs.Arg(0))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user %s", fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+	err = models.DeleteUser(ctx, user.PK)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %s\n", user.Email)
+	return nil
+}
+
+// placeNames maps the pks of the places, departments and regions to their
+// names.
+type placeNames struct {
+	places, departments, regions map[int]string
+}
+
+func selectPlaceNames(ctx context.Context) (placeNames, error) {
+	names := placeNames{make(map[int]string), make(map[int]string), make(map[int]string)}
+	dpts, err := models.SelectDepartments(ctx)
+	if err != nil {
+		return names, err
+	}
+	dptMap := make(map[int]models.Department)
+	for _, dpt := range dpts {
+		dptMap[dpt.PK] = dpt
+		names.departments[dpt.PK] = dpt.Name
+	}
+	places, err := models.SelectPlaces(ctx)
+	if err != nil {
+		return names, err
+	}
+	for _, place := range places {
+		names.places[place.PK] = formatPlace(place, dptMap[place.DepartmentPK])
+	}
+	regions, err := models.SelectRegions(ctx)
+	if err != nil {
+		return names, err
+	}
+	for _, region := range regions {
+		names.regions[region.PK] = region.Name
+	}
+	return names, nil
+}
+
+// of returns the names of the subscriptions, sorted.
+func (n placeNames) of(subs models.Subscriptions) []string {
+	var s []string
+	for _, pk := range subs.PlacePKs {
+		s = append(s, n.places[pk])
+	}
+	for _, pk := range subs.DepartmentPKs {
+		s = append(s, n.departments[pk])
+	}
+	for _, pk := range subs.RegionPKs {
+		s = append(s, n.regions[pk])
+	}
+	sort.Strings(s)
+	return s
+}
+
+// resolve returns the pks of values, which are pks or names in names,
+// compared without case.
+func (placeNames) resolve(kind string, names map[int]string, values []string) ([]int, error) {
+	var pks []int
+	for _, v := range values {
+		if pk, err := strconv.Atoi(v); err == nil {
+			if _, ok := names[pk]; !ok {
+				return nil, fmt.Errorf("no %s with pk %d", kind, pk)
+			}
+			pks = append(pks, pk)
+			continue
+		}
+		var matches []int
+		for pk, name := range names {
+			if strings.EqualFold(name, v) {
+				matches = append(matches, pk)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("no %s named %q", kind, v)
+		case 1:
+			pks = append(pks, matches[0])
+		default:
+			sort.Ints(matches)
+			return nil, fmt.Errorf("several %ss are named %q, use one of the pks %v", kind, v, matches)
+		}
+	}
+	return pks, nil
+}
+
+func sourcesCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing sources command: list, add, remove or test")
+	}
+	var nargs int
+	var usage string
+	switch args[0] {
+	case "list":
+		nargs, usage = 0, "pollbc sources list"
+	case "add":
+		nargs, usage = 2, "pollbc sources add name url"
+	case "remove":
+		nargs, usage = 1, "pollbc sources remove name"
+	case "test":
+		nargs, usage = 1, "pollbc sources test name|url"
+	default:
+		return fmt.Errorf("unknown sources command %q", args[0])
+	}
+	fs := flag.NewFlagSet("pollbc sources "+args[0], flag.ExitOnError)
+	cfg, err := setup(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, nargs, usage)
+	if err != nil {
+		return err
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+	a := &app{cfg: cfg}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		srcs, err := models.SelectSources(ctx)
+		if err != nil {
+			return err
+		}
+		if len(srcs) == 0 {
+			fmt.Printf("no sources, polling %s (source_url)\n", cfg.SourceURL)
+			return nil
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tURL\tCREATED")
+		for _, src := range srcs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", src.Name, src.URL, src.Created.In(cfg.Location).Format(time.RFC3339))
+		}
+		return tw.Flush()
+
+	case "add":
+		name, u := fs.Arg(0), fs.Arg(1)
+		if !isHTTPURL(u) {
+			return fmt.Errorf("invalid url %q", u)
+		}
+		_, err := models.InsertSource(ctx, name, u)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added %s\n", name)
+		return nil
+
+	case "remove":
+		err := models.DeleteSource(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", fs.Arg(0))
+		return nil
+
+	case "test":
+		src := models.Source{Name: "test", URL: fs.Arg(0)}
+		if !isHTTPURL(src.URL) {
+			src, err = models.SelectSourceWhereName(ctx, fs.Arg(0))
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("no source %s", fs.Arg(0))
+			} else if err != nil {
+				return err
+			}
+		}
+		err = setupRentControl(cfg.RentControlFile)
+		if err != nil {
+			return err
+		}
+		return a.testSource(ctx, os.Stdout, src)
+	}
+	return fmt.Errorf("unknown sources command %q", args[0])
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// notifyCommand queues the notifications of a time window again. They are
+// delivered by the outbox worker of serve.
+func notifyCommand(args []string) error {
+	fs := flag.NewFlagSet("pollbc notify", flag.ExitOnError)
+	resend := fs.Bool("resend", false, "notify the user again of the announces fetched during the window")
+	email := fs.String("user", "", "email of the user to notify")
+	since := fs.Duration("since", 24*time.Hour, "length of the window ending now, unless -from is set")
+	from := fs.String("from", "", "start of the window, as a date or an RFC 3339 time")
+	to := fs.String("to", "", "end of the window, as a date or an RFC 3339 time; defaults to now")
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	const usage = "pollbc notify -resend -user email [-since duration | -from date [-to date]]"
+	err = checkArgs(fs, 0, usage)
+	if err != nil {
+		return err
+	}
+	if !*resend || *email == "" {
+		return errors.New("usage: " + usage)
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+
+	end := time.Now()
+	if *to != "" {
+		end, err = parseDate(*to, cfg.Location, true)
+		if err != nil {
+			return fmt.Errorf("invalid -to %q", *to)
+		}
+	}
+	start := end.Add(-*since)
+	if *from != "" {
+		start, err = parseDate(*from, cfg.Location, false)
+		if err != nil {
+			return fmt.Errorf("invalid -from %q", *from)
+		}
+	}
+	if !start.Before(end) {
+		return errors.New("the window ends before it starts")
+	}
+
+	ctx := context.Background()
+	user, err := models.SelectUserWhereEmail(ctx, *email)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no user %s", *email)
+	} else if err != nil {
+		return err
+	}
+	n, err := models.ResendOutbox(ctx, user.PK, start, end)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("queued %d notifications of the announces fetched from %s to %s\n",
+		n, start.In(cfg.Location).Format(time.RFC3339), end.In(cfg.Location).Format(time.RFC3339))
+	return nil
+}
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	work, stop := drainContext(ctx, 50*time.Millisecond)
+	defer stop()
+
+	cancel()
+	if work.Err() != nil {
+		t.Fatal("work is done with ctx")
+	}
+	select {
+	case <-work.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work is not done after the grace period")
+	}
+
+	// Stopping releases the work context.
+	work, stop = drainContext(context.Background(), time.Hour)
+	stop()
+	if work.Err() == nil {
+		t.Error("work is not done after stop")
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	// The arguments are checked before connecting to the database.
+	t.Setenv("DATABASE_URL", "postgres://pollbc@127.0.0.1:1/pollbc?connect_timeout=1")
+	for _, tt := range []struct {
+		cmd  func([]string) error
+		args []string
+		want string
+	}{
+		{usersCommand, []string{"add", "foo@bar", "-digest", "daily"}, `unexpected arguments ["-digest" "daily"]`},
+		{usersCommand, []string{"add"}, "usage: pollbc users add"},
+		{usersCommand, []string{"list", "all"}, `unexpected arguments ["all"]`},
+		{usersCommand, []string{"remove", "foo@bar", "baz@bar"}, `unexpected arguments ["baz@bar"]`},
+		{sourcesCommand, []string{"add", "name"}, "usage: pollbc sources add name url"},
+		{sourcesCommand, []string{"test", "name", "-v"}, `unexpected arguments ["-v"]`},
+		{sourcesCommand, []string{"rename", "name"}, `unknown sources command "rename"`},
+		{pollCommand, []string{"-once", "now"}, `unexpected arguments ["now"]`},
+		{migrateCommand, []string{"now"}, `unexpected arguments ["now"]`},
+		{notifyCommand, []string{"-resend", "-user", "foo@bar", "1h"}, `unexpected arguments ["1h"]`},
+		{serve, []string{"web"}, `unexpected arguments ["web"]`},
+		{usersCommand, []string{"list"}, "connecting to the database"},
+	} {
+		err := tt.cmd(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %s", tt.args, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+// Package config loads the configuration of pollbc from a JSON file, the
+// environment and command-line flags. Each source overrides the previous
+// one, and the defaults apply to what none of them sets.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Config is the configuration of pollbc.
+type Config struct {
+	// Port is the port of the HTTP server.
+	Port        string `json:"port"`
+	DatabaseURL string `json:"database_url"`
+	// SecretKey signs the links sent by email and the session cookies.
+	SecretKey string `json:"secret_key"`
+	// BaseURL is the URL of the site in links sent by email and in feeds.
+	BaseURL string `json:"base_url"`
+	// TimeZone is the time zone of the dates of the source and of the days
+	// of the statistics.
+	TimeZone string         `json:"time_zone"`
+	Location *time.Location `json:"-"`
+	// SourceURL is the page of announces that is polled.
+	SourceURL         string   `json:"source_url"`
+	PollInterval      Duration `json:"poll_interval"`
+	PollRetryInterval Duration `json:"poll_retry_interval"`
+	// PollStaleAfter is how long a source may go without a successful
+	// poll before the server is not ready.
+	PollStaleAfter Duration `json:"poll_stale_after"`
+	// FetchTimeout bounds the fetch of a source. It is shorter than the
+	// poll intervals, after which another poller may fetch the source.
+	FetchTimeout Duration `json:"fetch_timeout"`
+	// Retention is how long announces are kept after their date.
+	Retention Duration `json:"retention"`
+	// PageSize is the number of announces per page of the index.
+	PageSize int `json:"page_size"`
+	// ShutdownTimeout bounds the time to stop after SIGTERM.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// RentControlFile is the table of the rent caps in Paris. Rents are not
+	// checked without it.
+	RentControlFile string `json:"rent_control_file"`
+	// MetricsToken is the bearer token that /metrics requires, when it is
+	// set. /metrics is public otherwise.
+	MetricsToken     string `json:"metrics_token"`
+	TelegramBotToken string `json:"telegram_bot_token"`
+	Mail             Mail   `json:"mail"`
+	Log              Log    `json:"log"`
+	// Roles are the parts of pollbc that serve runs. Each can run in
+	// processes of its own, which communicate through the database only.
+	Roles Roles `json:"roles"`
+}
+
+// The roles of a process.
+const (
+	// RoleWeb serves the site, the API and the feeds.
+	RoleWeb = "web"
+	// RolePoller fetches the sources and queues the notifications.
+	RolePoller = "poller"
+	// RoleNotifier delivers the notifications.
+	RoleNotifier = "notifier"
+	// RoleJanitor deletes the old announces.
+	RoleJanitor = "janitor"
+)
+
+// Roles is a list of roles, written "web,poller" in flags and the
+// environment.
+type Roles []string
+
+// Has reports whether role is in r.
+func (r Roles) Has(role string) bool {
+	return oneOf(role, r...)
+}
+
+// Set implements flag.Value.
+func (r *Roles) Set(s string) error {
+	*r = nil
+	for _, role := range strings.Split(s, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			*r = append(*r, role)
+		}
+	}
+	return nil
+}
+
+func (r *Roles) String() string { return strings.Join(*r, ",") }
+
+// Mail configures the sending of emails.
+type Mail struct {
+	From string `json:"from"`
+	SMTP SMTP   `json:"smtp"`
+	// Fallback is used when SMTP is down. It is disabled when its server
+	// is empty, and its TLS and auth default to those of SMTP.
+	Fallback SMTP `json:"fallback"`
+	// Rate is the maximum number of emails sent per minute, or 0 for no
+	// limit.
+	Rate int  `json:"rate"`
+	DKIM DKIM `json:"dkim"`
+}
+
+// SMTP is an SMTP relay.
+type SMTP struct {
+	Server   string `json:"server"`
+	Port     string `json:"port"`
+	TLS      string `json:"tls"`
+	Auth     string `json:"auth"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// DKIM configures the signature of emails. It is disabled when KeyFile is
+// empty, and Domain defaults to the domain of Mail.From.
+type DKIM struct {
+	KeyFile  string `json:"key_file"`
+	Selector string `json:"selector"`
+	Domain   string `json:"domain"`
+}
+
+// Log configures logging.
+type Log struct {
+	// Level is debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is json or text.
+	Format string `json:"format"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		BaseURL:           "https://pollbc.herokuapp.com",
+		TimeZone:          "Europe/Paris",
+		SourceURL:         "http://www.leboncoin.fr/colocations/offres/ile_de_france",
+		PollInterval:      Duration{5 * time.Second},
+		PollRetryInterval: Duration{time.Minute},
+		PollStaleAfter:    Duration{10 * time.Minute},
+		FetchTimeout:      Duration{4 * time.Second},
+		Retention:         Duration{30 * 24 * time.Hour},
+		PageSize:          35,
+		// Heroku kills the process 30 seconds after SIGTERM.
+		ShutdownTimeout: Duration{25 * time.Second},
+		Mail: Mail{
+			From: `"pollbc" <yann@pollbc.herokuapp.com>`,
+			SMTP: SMTP{TLS: "starttls", Auth: "plain"},
+		},
+		Log:   Log{Level: "info", Format: "json"},
+		Roles: Roles{RoleWeb, RolePoller, RoleNotifier, RoleJanitor},
+	}
+}
+
+// A Duration is a time.Duration written as "5s" or "1h30m" in files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Set implements flag.Value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type stringValue string
+
+func (s *stringValue) Set(v string) error { *s = stringValue(v); return nil }
+func (s *stringValue) String() string     { return string(*s) }
+
+type intValue int
+
+func (i *intValue) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*i = intValue(n)
+	return nil
+}
+
+func (i *intValue) String() string { return strconv.Itoa(int(*i)) }
+
+// A setting is a field of Config that can be set by a flag and environment
+// variables. The first variable that is not empty wins.
+type setting struct {
+	flag  string
+	env   []string
+	usage string
+	value func(c *Config) flag.Value
+}
+
+func str(p *string) flag.Value { return (*stringValue)(p) }
+
+var settings = []setting{
+	{"port", []string{"PORT"}, "port of the HTTP server",
+		func(c *Config) flag.Value { return str(&c.Port) }},
+	{"database-url", []string{"DATABASE_URL"}, "PostgreSQL connection string",
+		func(c *Config) flag.Value { return str(&c.DatabaseURL) }},
+	{"secret-key", []string{"SECRET_KEY"}, "key signing links and sessions",
+		func(c *Config) flag.Value { return str(&c.SecretKey) }},
+	{"base-url", []string{"BASE_URL"}, "URL of the site in emails and feeds",
+		func(c *Config) flag.Value { return str(&c.BaseURL) }},
+	{"time-zone", []string{"TIME_ZONE"}, "time zone of the dates of the source",
+		func(c *Config) flag.Value { return str(&c.TimeZone) }},
+	{"source-url", []string{"SOURCE_URL"}, "page of announces to poll",
+		func(c *Config) flag.Value { return str(&c.SourceURL) }},
+	{"poll-interval", []string{"POLL_INTERVAL"}, "time between polls",
+		func(c *Config) flag.Value { return &c.PollInterval }},
+	{"poll-retry-interval", []string{"POLL_RETRY_INTERVAL"}, "time between polls after an error",
+		func(c *Config) flag.Value { return &c.PollRetryInterval }},
+	{"poll-stale-after", []string{"POLL_STALE_AFTER"}, "time without a successful poll before /readyz fails",
+		func(c *Config) flag.Value { return &c.PollStaleAfter }},
+	{"fetch-timeout", []string{"FETCH_TIMEOUT"}, "timeout of the fetch of a source",
+		func(c *Config) flag.Value { return &c.FetchTimeout }},
+	{"retention", []string{"RETENTION"}, "how long announces are kept",
+		func(c *Config) flag.Value { return &c.Retention }},
+	{"page-size", []string{"PAGE_SIZE"}, "announces per page of the index",
+		func(c *Config) flag.Value { return (*intValue)(&c.PageSize) }},
+	{"shutdown-timeout", []string{"SHUTDOWN_TIMEOUT"}, "time to stop after SIGTERM",
+		func(c *Config) flag.Value { return &c.ShutdownTimeout }},
+	{"rent-control-file", []string{"RENT_CONTROL_FILE"}, "CSV export of the logement-encadrement-des-loyers dataset of opendata.paris.fr",
+		func(c *Config) flag.Value { return str(&c.RentControlFile) }},
+	{"metrics-token", []string{"METRICS_TOKEN"}, "bearer token required by /metrics, if any",
+		func(c *Config) flag.Value { return str(&c.MetricsToken) }},
+	{"telegram-bot-token", []string{"TELEGRAM_BOT_TOKEN"}, "token of the Telegram bot",
+		func(c *Config) flag.Value { return str(&c.TelegramBotToken) }},
+	{"mail-from", []string{"MAIL_FROM"}, "sender of emails",
+		func(c *Config) flag.Value { return str(&c.Mail.From) }},
+	{"smtp-server", []string{"SMTP_SERVER", "MAILGUN_SMTP_SERVER"}, "SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.Server) }},
+	{"smtp-port", []string{"SMTP_PORT", "MAILGUN_SMTP_PORT"}, "port of the SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.Port) }},
+	{"smtp-tls", []string{"SMTP_TLS"}, "starttls, implicit or none",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.TLS) }},
+	{"smtp-auth", []string{"SMTP_AUTH"}, "plain, login, cram-md5 or none",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.Auth) }},
+	{"smtp-login", []string{"SMTP_LOGIN", "MAILGUN_SMTP_LOGIN"}, "SMTP login",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.Login) }},
+	{"smtp-password", []string{"SMTP_PASSWORD", "MAILGUN_SMTP_PASSWORD"}, "SMTP password",
+		func(c *Config) flag.Value { return str(&c.Mail.SMTP.Password) }},
+	{"smtp-fallback-server", []string{"SMTP_FALLBACK_SERVER"}, "SMTP relay used when the first one is down",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.Server) }},
+	{"smtp-fallback-port", []string{"SMTP_FALLBACK_PORT"}, "port of the fallback SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.Port) }},
+	{"smtp-fallback-tls", []string{"SMTP_FALLBACK_TLS"}, "TLS of the fallback SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.TLS) }},
+	{"smtp-fallback-auth", []string{"SMTP_FALLBACK_AUTH"}, "auth of the fallback SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.Auth) }},
+	{"smtp-fallback-login", []string{"SMTP_FALLBACK_LOGIN"}, "login of the fallback SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.Login) }},
+	{"smtp-fallback-password", []string{"SMTP_FALLBACK_PASSWORD"}, "password of the fallback SMTP relay",
+		func(c *Config) flag.Value { return str(&c.Mail.Fallback.Password) }},
+	{"smtp-rate", []string{"SMTP_RATE"}, "maximum emails per minute",
+		func(c *Config) flag.Value { return (*intValue)(&c.Mail.Rate) }},
+	{"dkim-key-file", []string{"DKIM_KEY_FILE"}, "PEM private key signing emails",
+		func(c *Config) flag.Value { return str(&c.Mail.DKIM.KeyFile) }},
+	{"dkim-selector", []string{"DKIM_SELECTOR"}, "DKIM selector",
+		func(c *Config) flag.Value { return str(&c.Mail.DKIM.Selector) }},
+	{"dkim-domain", []string{"DKIM_DOMAIN"}, "DKIM domain",
+		func(c *Config) flag.Value { return str(&c.Mail.DKIM.Domain) }},
+	{"log-level", []string{"LOG_LEVEL"}, "debug, info, warn or error",
+		func(c *Config) flag.Value { return str(&c.Log.Level) }},
+	{"log-format", []string{"LOG_FORMAT"}, "json or text",
+		func(c *Config) flag.Value { return str(&c.Log.Format) }},
+	{"roles", []string{"ROLES"}, "comma-separated roles of serve: web, poller, notifier, janitor",
+		func(c *Config) flag.Value { return &c.Roles }},
+}
+
+// A Loader loads the configuration once its flags are parsed.
+type Loader struct {
+	fs    *flag.FlagSet
+	file  string
+	flags *Config
+}
+
+// NewLoader defines the flags of the configuration on fs, and -config, the
+// path of the JSON file, which defaults to $CONFIG_FILE.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{fs: fs, flags: Default()}
+	fs.StringVar(&l.file, "config", os.Getenv("CONFIG_FILE"), "JSON configuration file")
+	for _, s := range settings {
+		usage := s.usage + " ($" + s.env[0] + ")"
+		fs.Var(s.value(l.flags), s.flag, usage)
+	}
+	return l
+}
+
+// Load returns the validated configuration.
+func (l *Loader) Load() (*Config, error) {
+	c := Default()
+	if l.file != "" {
+		b, err := os.ReadFile(l.file)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", l.file, err)
+		}
+	}
+	for _, s := range settings {
+		for _, env := range s.env {
+			v := os.Getenv(env)
+			if v == "" {
+				continue
+			}
+			err := s.value(c).Set(v)
+			if err != nil {
+				return nil, fmt.Errorf("$%s: %v", env, err)
+			}
+			break
+		}
+	}
+	var err error
+	l.fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.value(c).Set(f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// Validate checks c and sets the fields derived from others.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if c.Port != "" {
+		port, err := strconv.Atoi(c.Port)
+		check(err == nil && port > 0 && port < 1<<16, "port: invalid port %q", c.Port)
+	}
+	u, err := url.Parse(c.BaseURL)
+	check(err == nil && u.IsAbs() && strings.Trim(u.Path, "/") == "", "base_url: %q is not an absolute URL without path", c.BaseURL)
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	c.Location, err = time.LoadLocation(c.TimeZone)
+	check(err == nil, "time_zone: %v", err)
+	u, err = url.Parse(c.SourceURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https"), "source_url: %q is not an HTTP URL", c.SourceURL)
+	check(c.PollInterval.Duration > 0, "poll_interval: must be positive")
+	check(c.PollRetryInterval.Duration > 0, "poll_retry_interval: must be positive")
+	check(c.PollStaleAfter.Duration > c.PollInterval.Duration, "poll_stale_after: must be longer than poll_interval")
+	check(c.FetchTimeout.Duration > 0 && c.FetchTimeout.Duration < min(c.PollInterval.Duration, c.PollRetryInterval.Duration),
+		"fetch_timeout: must be positive and shorter than poll_interval and poll_retry_interval")
+	check(c.Retention.Duration >= 24*time.Hour, "retention: must be at least 24h")
+	check(c.PageSize > 0 && c.PageSize <= 100, "page_size: must be between 1 and 100")
+	check(c.ShutdownTimeout.Duration > 0, "shutdown_timeout: must be positive")
+
+	_, err = mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from: %v", err)
+	if c.Mail.Fallback.Server != "" {
+		if c.Mail.Fallback.TLS == "" {
+			c.Mail.Fallback.TLS = c.Mail.SMTP.TLS
+		}
+		if c.Mail.Fallback.Auth == "" {
+			c.Mail.Fallback.Auth = c.Mail.SMTP.Auth
+		}
+	}
+	relays := []SMTP{c.Mail.SMTP}
+	if c.Mail.Fallback.Server != "" {
+		relays = append(relays, c.Mail.Fallback)
+	}
+	for i, relay := range relays {
+		name := []string{"mail.smtp", "mail.fallback"}[i]
+		check(oneOf(relay.TLS, "starttls", "implicit", "none"), "%s.tls: %q is not starttls, implicit or none", name, relay.TLS)
+		check(oneOf(relay.Auth, "plain", "login", "cram-md5", "none"), "%s.auth: %q is not plain, login, cram-md5 or none", name, relay.Auth)
+	}
+	check(c.Mail.Rate >= 0, "mail.rate: must not be negative")
+	check(c.Mail.DKIM.KeyFile == "" || c.Mail.DKIM.Selector != "", "mail.dkim.selector: must be set with mail.dkim.key_file")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: %q is not debug, info, warn or error", c.Log.Level)
+	check(oneOf(c.Log.Format, "json", "text"), "log.format: %q is not json or text", c.Log.Format)
+	check(len(c.Roles) > 0, "roles: must not be empty")
+	for _, role := range c.Roles {
+		check(oneOf(role, RoleWeb, RolePoller, RoleNotifier, RoleJanitor), "roles: %q is not web, poller, notifier or janitor", role)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Require checks that the settings named by their key in files, among
+// port, database_url and secret_key, are set.
+func (c *Config) Require(names ...string) error {
+	values := map[string]string{"port": c.Port, "database_url": c.DatabaseURL, "secret_key": c.SecretKey}
+	var errs []error
+	for _, name := range names {
+		if values[name] == "" {
+			errs = append(errs, fmt.Errorf("%s: must be set", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
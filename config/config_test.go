@@ -0,0 +1,190 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// load loads the configuration with the flags args, the file content, if
+// not empty, and the current environment.
+func load(t *testing.T, content string, args ...string) (*Config, error) {
+	t.Helper()
+	if content != "" {
+		file := filepath.Join(t.TempDir(), "config.json")
+		err := os.WriteFile(file, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", file}, args...)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	l := NewLoader(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l.Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	t.Setenv("PORT", "2000")
+	t.Setenv("TIME_ZONE", "UTC")
+	c, err := load(t, `{"port": "1000", "time_zone": "Europe/London", "page_size": 10, "poll_interval": "1m"}`,
+		"-port", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != "3000" {
+		t.Errorf("port: got %q, want the flag", c.Port)
+	}
+	if c.TimeZone != "UTC" || c.Location != time.UTC {
+		t.Errorf("time_zone: got %q (%v), want the environment", c.TimeZone, c.Location)
+	}
+	if c.PageSize != 10 || c.PollInterval.Duration != time.Minute {
+		t.Errorf("page_size, poll_interval: got %d, %v, want the file", c.PageSize, c.PollInterval)
+	}
+	if def := Default(); c.Retention != def.Retention || c.SourceURL != def.SourceURL {
+		t.Errorf("retention, source_url: got %v, %q, want the defaults", c.Retention, c.SourceURL)
+	}
+}
+
+func TestLoadConfigFileEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"page_size": 20}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", file)
+	c, err := load(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PageSize != 20 {
+		t.Errorf("page_size: got %d, want the one of $CONFIG_FILE", c.PageSize)
+	}
+}
+
+func TestLoadEnvFallback(t *testing.T) {
+	t.Setenv("MAILGUN_SMTP_SERVER", "smtp.mailgun.org")
+	t.Setenv("MAILGUN_SMTP_LOGIN", "postmaster")
+	t.Setenv("SMTP_LOGIN", "pollbc")
+	c, err := load(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mail.SMTP.Server != "smtp.mailgun.org" {
+		t.Errorf("mail.smtp.server: got %q, want $MAILGUN_SMTP_SERVER", c.Mail.SMTP.Server)
+	}
+	if c.Mail.SMTP.Login != "pollbc" {
+		t.Errorf("mail.smtp.login: got %q, want $SMTP_LOGIN", c.Mail.SMTP.Login)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		args    []string
+		env     map[string]string
+		want    string
+	}{
+		{"file", `{"page_size": "ten"}`, nil, nil, "config.json"},
+		{"env", "", nil, map[string]string{"POLL_INTERVAL": "often"}, "$POLL_INTERVAL"},
+		{"flag", "", []string{"-page-size", "0"}, nil, "page_size: must be between 1 and 100"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			_, err := load(t, tt.content, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		set  func(c *Config)
+		want string
+	}{
+		{func(c *Config) { c.Port = "http" }, `port: invalid port "http"`},
+		{func(c *Config) { c.Port = "70000" }, `port: invalid port "70000"`},
+		{func(c *Config) { c.BaseURL = "https://example.com/pollbc" }, "base_url:"},
+		{func(c *Config) { c.TimeZone = "Europe/Nowhere" }, "time_zone:"},
+		{func(c *Config) { c.SourceURL = "ftp://example.com" }, "source_url:"},
+		{func(c *Config) { c.PollInterval.Duration = 0 }, "poll_interval: must be positive"},
+		{func(c *Config) { c.PollRetryInterval.Duration = -time.Second }, "poll_retry_interval: must be positive"},
+		{func(c *Config) { c.PollStaleAfter.Duration = time.Second }, "poll_stale_after: must be longer than poll_interval"},
+		{func(c *Config) { c.FetchTimeout.Duration = 0 }, "fetch_timeout: must be positive"},
+		{func(c *Config) { c.FetchTimeout.Duration = c.PollInterval.Duration }, "fetch_timeout: must be positive and shorter than poll_interval"},
+		{func(c *Config) { c.PollRetryInterval.Duration = time.Second }, "fetch_timeout: must be positive and shorter than poll_interval and poll_retry_interval"},
+		{func(c *Config) { c.Retention.Duration = time.Hour }, "retention: must be at least 24h"},
+		{func(c *Config) { c.PageSize = 101 }, "page_size: must be between 1 and 100"},
+		{func(c *Config) { c.ShutdownTimeout.Duration = 0 }, "shutdown_timeout: must be positive"},
+		{func(c *Config) { c.Mail.From = "pollbc" }, "mail.from:"},
+		{func(c *Config) { c.Mail.SMTP.TLS = "ssl" }, `mail.smtp.tls: "ssl" is not starttls, implicit or none`},
+		{func(c *Config) { c.Mail.Fallback = SMTP{Server: "smtp.example.com", Auth: "md5"} }, `mail.fallback.auth: "md5"`},
+		{func(c *Config) { c.Mail.Rate = -1 }, "mail.rate: must not be negative"},
+		{func(c *Config) { c.Mail.DKIM.KeyFile = "dkim.pem" }, "mail.dkim.selector: must be set with mail.dkim.key_file"},
+		{func(c *Config) { c.Log.Level = "verbose" }, `log.level: "verbose"`},
+		{func(c *Config) { c.Log.Format = "xml" }, `log.format: "xml"`},
+		{func(c *Config) { c.Roles = nil }, "roles: must not be empty"},
+		{func(c *Config) { c.Roles = Roles{RoleWeb, "cron"} }, `roles: "cron" is not web, poller, notifier or janitor`},
+	} {
+		c := Default()
+		tt.set(c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("got error %v, want %q", err, tt.want)
+		}
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	c := Default()
+	c.PageSize = 0
+	c.Log.Format = "xml"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, want := range []string{"page_size:", "log.format:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := Default()
+	c.BaseURL = "https://example.com/"
+	c.Mail.Fallback = SMTP{Server: "smtp.example.com"}
+	err := c.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BaseURL != "https://example.com" {
+		t.Errorf("base_url: got %q, want no trailing slash", c.BaseURL)
+	}
+	if c.Mail.Fallback.TLS != "starttls" || c.Mail.Fallback.Auth != "plain" {
+		t.Errorf("mail.fallback: got %+v, want the TLS and auth of mail.smtp", c.Mail.Fallback)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	c := Default()
+	c.DatabaseURL = "sslmode=disable"
+	err := c.Require("database_url", "port", "secret_key")
+	if err == nil || !strings.Contains(err.Error(), "port: must be set") || !strings.Contains(err.Error(), "secret_key: must be set") {
+		t.Errorf("got error %v, want port and secret_key to be required", err)
+	}
+	if err := c.Require("database_url"); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
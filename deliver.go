@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+const (
+	outboxBatch = 500
+	// outboxLease is how long a claimed item may go without an update
+	// before its worker is considered dead.
+	outboxLease       = 10 * time.Minute
+	outboxMaxAttempts = 8
+	// outboxUpdateTimeout bounds the update of the outbox that follows a
+	// delivery, which isn't interrupted with it.
+	outboxUpdateTimeout = 5 * time.Second
+)
+
+var errInactiveUser = errors.New("user is not active")
+
+// deliverOutbox sends the queued notifications until ctx is done. Items of
+// the same user and channel are grouped in one message. The message being
+// sent when ctx is done may finish during three quarters of the shutdown
+// timeout; it is interrupted after that and given up for review. The other
+// claimed items are released.
+func (a *app) deliverOutbox(ctx context.Context) {
+	work, cancel := drainContext(ctx, a.cfg.ShutdownTimeout.Duration*3/4)
+	defer cancel()
+	for {
+		retried, failed, err := models.RetryStaleClaims(ctx, outboxLease, outboxMaxAttempts)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("retrying stale claims", "err", err)
+		}
+		if retried != 0 || failed != 0 {
+			slog.Warn("released interrupted notifications", "retried", retried, "failed", failed)
+		}
+
+		items, err := models.ClaimOutbox(ctx, outboxBatch)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("claiming outbox", "err", err)
+		}
+		type key struct{ userPK, channelPK int }
+		var keys []key
+		groups := make(map[key][]models.OutboxItem)
+		for _, item := range items {
+			k := key{item.UserPK, item.ChannelPK}
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], item)
+		}
+		for i, k := range keys {
+			if ctx.Err() != nil {
+				var rest []models.OutboxItem
+				for _, k := range keys[i:] {
+					rest = append(rest, groups[k]...)
+				}
+				releaseOutbox(work, rest)
+				return
+			}
+			a.deliver(work, groups[k])
+		}
+
+		if len(items) < outboxBatch && !sleep(ctx, 5*time.Second) {
+			return
+		}
+	}
+}
+
+// releaseOutbox returns items, which were claimed together, to the queue.
+func releaseOutbox(ctx context.Context, items []models.OutboxItem) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxUpdateTimeout)
+	defer cancel()
+	// Items claimed together may belong to several groups.
+	byClaim := make(map[int64][]models.OutboxItem)
+	for _, item := range items {
+		byClaim[item.Claim] = append(byClaim[item.Claim], item)
+	}
+	for _, items := range byClaim {
+		err := models.ReleaseOutbox(ctx, items)
+		if err != nil {
+			slog.Error("releasing outbox", "err", err)
+		}
+	}
+}
+
+// deliver sends items, which share their user and channel, and records the
+// outcome. Items are never sent twice: those whose sending was interrupted,
+// because ctx is done or it timed out, may have been sent and are given up
+// for review. Those interrupted before sending are released.
+func (a *app) deliver(ctx context.Context, items []models.OutboxItem) {
+	var pks []int
+	for _, item := range items {
+		pks = append(pks, item.AnnouncePK)
+	}
+	logger := slog.With("user", items[0].UserPK, "channel", items[0].ChannelPK, "announces", pks)
+	kind, sending, err := a.send(ctx, logger, items)
+	if kind == "" {
+		kind = "unknown"
+	}
+	// The outcome is recorded even if ctx is done.
+	update, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxUpdateTimeout)
+	defer cancel()
+	if err == nil {
+		notificationsSent.Add(float64(len(items)), kind)
+		err = models.MarkOutboxSent(update, items)
+		if err != nil {
+			logger.Error("marking outbox sent", "err", err)
+		}
+		return
+	}
+	if err == models.ErrClaimLost {
+		logger.Warn("notifications claimed by another worker", "err", err)
+		return
+	}
+	if sending && (ctx.Err() != nil || isTimeout(err)) {
+		logger.Error("sending interrupted, notifications need review", "err", err, "kind", kind)
+		notificationsFailed.Add(float64(len(items)), kind)
+		err = models.MarkOutboxFailed(update, items, fmt.Errorf("%w: %v", models.ErrInterruptedSend, err))
+		if err != nil {
+			logger.Error("updating outbox", "err", err)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		logger.Warn("delivery interrupted by the shutdown before sending", "err", err)
+		err = models.ReleaseOutbox(update, items)
+		if err != nil {
+			logger.Error("updating outbox", "err", err)
+		}
+		return
+	}
+
+	// Items queued at different times may have been tried a different
+	// number of times.
+	attempts := 0
+	for _, item := range items {
+		attempts = max(attempts, item.Attempts)
+	}
+	if err == errInactiveUser {
+		// A deliberate skip rather than a failure.
+		logger.Info("skipping notifications", "reason", err)
+		err = models.MarkOutboxFailed(update, items, err)
+		if err != nil {
+			logger.Error("updating outbox", "err", err)
+		}
+		return
+	}
+	logger.Error("delivering notifications", "err", err, "kind", kind, "attempts", attempts)
+	notificationsFailed.Add(float64(len(items)), kind)
+	if attempts >= outboxMaxAttempts {
+		err = models.MarkOutboxFailed(update, items, err)
+	} else {
+		err = models.RetryOutbox(update, items, err, backoff(attempts))
+	}
+	if err != nil {
+		logger.Error("updating outbox", "err", err)
+	}
+}
+
+// isTimeout reports whether err is a timeout, after which a notification
+// may have been sent or not.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// send returns the kind of the channel of items, if known, and whether the
+// notifier was called.
+func (a *app) send(ctx context.Context, logger *slog.Logger, items []models.OutboxItem) (string, bool, error) {
+	user, err := models.SelectUserWherePK(ctx, items[0].UserPK)
+	if err != nil {
+		return "", false, err
+	}
+	if !user.Active {
+		return "", false, errInactiveUser
+	}
+	ch, err := models.SelectChannelWherePK(ctx, items[0].ChannelPK)
+	if err != nil {
+		return "", false, err
+	}
+	var pks []int
+	for _, item := range items {
+		pks = append(pks, item.AnnouncePK)
+	}
+	announces, err := models.SelectAnnouncesWherePKs(ctx, pks)
+	if err != nil {
+		return ch.Kind, false, err
+	}
+	if len(announces) == 0 {
+		// The announces were deleted in the meantime.
+		return ch.Kind, false, nil
+	}
+
+	n, err := a.newNotifier(ch)
+	if err != nil {
+		return ch.Kind, false, err
+	}
+	err = models.MarkOutboxSending(ctx, items)
+	if err != nil {
+		return ch.Kind, false, err
+	}
+	err = n.Notify(ctx, user, announces)
+	if err != nil {
+		return ch.Kind, true, &notifyError{err, user.Email, announces}
+	}
+	logger.Info("notified", "email", user.Email, "kind", ch.Kind, "notified", len(announces))
+
+	if user.DigestPeriod() != 0 {
+		err = models.UpdateUserDigestSent(ctx, user.PK, time.Now())
+		if err != nil {
+			logger.Error("updating digest time", "err", err)
+		}
+	}
+	return ch.Kind, true, nil
+}
+
+// A notifyError is an error of a notifier. It is logged with the email of
+// the user and the URLs of the announces.
+type notifyError struct {
+	err       error
+	email     string
+	announces []models.Announce
+}
+
+func (e *notifyError) Unwrap() error { return e.err }
+
+func (e *notifyError) Error() string {
+	return fmt.Sprintf("notify %v: %v", e.email, e.err)
+}
+
+func (e *notifyError) LogValue() slog.Value {
+	var urls []string
+	for _, ann := range e.announces {
+		urls = append(urls, ann.URL)
+	}
+	return slog.GroupValue(
+		slog.String("message", e.err.Error()),
+		slog.String("email", e.email),
+		slog.Any("urls", urls))
+}
+
+// backoff returns the delay before the next attempt: 1 minute, then twice
+// as long after each failure.
+func backoff(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d): got %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestClaimOutbox(t *testing.T) {
+	fake := useFakeDB(t, []driver.Value{int64(1), int64(2), int64(3), int64(4), int64(1), int64(7)})
+	items, err := models.ClaimOutbox(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.OutboxItem{PK: 1, UserPK: 2, AnnouncePK: 3, ChannelPK: 4, Attempts: 1, Claim: 7}
+	if len(items) != 1 || items[0] != want {
+		t.Errorf("got %+v, want %+v", items, want)
+	}
+	for _, cond := range []string{"claimed IS NULL", "deliver_after <= now()", "attempts = attempts + 1", "SKIP LOCKED"} {
+		if !strings.Contains(fake.queries[0], cond) {
+			t.Errorf("query %q doesn't contain %q", fake.queries[0], cond)
+		}
+	}
+}
+
+func TestRetryStaleClaims(t *testing.T) {
+	fake := useFakeDB(t, []driver.Value{false}, []driver.Value{true}, []driver.Value{false})
+	retried, failed, err := models.RetryStaleClaims(context.Background(), 10*time.Minute, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried != 2 || failed != 1 {
+		t.Errorf("got %d retried, %d failed, want 2, 1", retried, failed)
+	}
+	// The items being sent are given up instead of sent again.
+	if !strings.Contains(fake.queries[0], "WHEN sending IS NOT NULL OR attempts >= $2 THEN now()") {
+		t.Errorf("query %q doesn't give up the items being sent", fake.queries[0])
+	}
+	if fake.args[0][0].Value != int64(600) || fake.args[0][1].Value != int64(8) {
+		t.Errorf("got args %v, want the lease in seconds and the max attempts", fake.args[0])
+	}
+}
+
+func TestUpdateOutboxClaimGuard(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.affected = 1
+	items := []models.OutboxItem{{PK: 1, Claim: 7}, {PK: 2, Claim: 7}}
+	err := models.MarkOutboxSent(context.Background(), items)
+	if err != models.ErrClaimLost {
+		t.Errorf("got error %v, want %v", err, models.ErrClaimLost)
+	}
+	if !strings.Contains(fake.queries[0], "WHERE claim = $1 AND sent IS NULL AND failed IS NULL AND pk IN ($2, $3)") {
+		t.Errorf("query %q isn't guarded by the claim", fake.queries[0])
+	}
+	if fake.args[0][0].Value != int64(7) {
+		t.Errorf("got claim %v, want 7", fake.args[0][0].Value)
+	}
+
+	fake.affected = 2
+	if err := models.MarkOutboxSent(context.Background(), items); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// useFakeOutbox makes the models answer the queries of a delivery to a
+// webhook handled by h, and returns the fake database.
+func useFakeOutbox(t *testing.T, h http.HandlerFunc) *fakeDB {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	client := publicClient
+	publicClient = srv.Client()
+	t.Cleanup(func() { publicClient = client })
+
+	fake := useFakeDB(t)
+	fake.affected = 1
+	fake.answer = func(query string, args []driver.NamedValue) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "FROM pollbc_users"):
+			return [][]driver.Value{{int64(1), "bob@example.com", true, models.FrequencyImmediate, time.Now(), "Europe/Paris", int64(0), int64(0), false}}
+		case strings.Contains(query, "FROM pollbc_channels"):
+			return [][]driver.Value{{int64(1), int64(1), models.ChannelWebhook, srv.URL}}
+		case strings.Contains(query, "FROM pollbc_announces"):
+			return [][]driver.Value{announceRow(3, time.Now())}
+		}
+		return nil
+	}
+	return fake
+}
+
+func TestDeliver(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   int
+		attempts int
+		affected int64
+		want     string
+	}{
+		{"sent", http.StatusOK, 1, 1, "sent = now()"},
+		{"retried", http.StatusInternalServerError, 2, 1, "claimed = NULL, sending = NULL, deliver_after = now() + $1 * interval '1 second'"},
+		{"max attempts", http.StatusInternalServerError, outboxMaxAttempts, 1, "failed = now()"},
+		{"claim lost", http.StatusOK, 1, 0, "sending = now()"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var posts int
+			fake := useFakeOutbox(t, func(w http.ResponseWriter, r *http.Request) {
+				posts++
+				w.WriteHeader(tt.status)
+			})
+			fake.affected = tt.affected
+			newTestApp(t).deliver(context.Background(), []models.OutboxItem{{PK: 1, UserPK: 1, AnnouncePK: 3, ChannelPK: 1, Attempts: tt.attempts, Claim: 7}})
+
+			last := fake.queries[len(fake.queries)-1]
+			if !strings.Contains(last, tt.want) {
+				t.Errorf("got last query %q, want %q", last, tt.want)
+			}
+			wantPosts := 1
+			if tt.affected == 0 {
+				// Another worker claimed the item in the meantime.
+				wantPosts = 0
+			}
+			if posts != wantPosts {
+				t.Errorf("got %d posts, want %d", posts, wantPosts)
+			}
+			if tt.name == "retried" {
+				delay := fake.args[len(fake.args)-1][0].Value
+				if delay != int64(backoff(2)/time.Second) {
+					t.Errorf("got delay %v, want %v", delay, backoff(2))
+				}
+			}
+		})
+	}
+}
+
+func TestDeliverInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := useFakeOutbox(t, func(w http.ResponseWriter, r *http.Request) {
+		// The worker stops while the webhook is being posted.
+		io.Copy(io.Discard, r.Body)
+		cancel()
+		<-r.Context().Done()
+	})
+	newTestApp(t).deliver(ctx, []models.OutboxItem{{PK: 1, UserPK: 1, AnnouncePK: 3, ChannelPK: 1, Attempts: 1, Claim: 7}})
+
+	last := fake.queries[len(fake.queries)-1]
+	if !strings.Contains(last, "failed = now()") {
+		t.Fatalf("got last query %q, want the item given up", last)
+	}
+	cause, _ := fake.args[len(fake.args)-1][0].Value.(string)
+	if !strings.HasPrefix(cause, models.ErrInterruptedSend.Error()) {
+		t.Errorf("got last error %q, want %q", cause, models.ErrInterruptedSend)
+	}
+}
+
+func TestDeliverStoppedBeforeSending(t *testing.T) {
+	var posts int
+	fake := useFakeOutbox(t, func(w http.ResponseWriter, r *http.Request) { posts++ })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	newTestApp(t).deliver(ctx, []models.OutboxItem{{PK: 1, UserPK: 1, AnnouncePK: 3, ChannelPK: 1, Attempts: 1, Claim: 7}})
+
+	last := fake.queries[len(fake.queries)-1]
+	if !strings.Contains(last, "claimed = NULL, attempts = attempts - 1") || !strings.Contains(last, "sending IS NULL") {
+		t.Errorf("got last query %q, want the item released", last)
+	}
+	if posts != 0 {
+		t.Errorf("got %d posts, want 0", posts)
+	}
+}
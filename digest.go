@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"github.com/yansal/pollbc/models"
+)
+
+type digestGroup struct {
+	Place     string
+	Announces []models.Announce
+}
+
+// groupByPlace splits announces, which must be ordered by place, into one
+// group per place.
+func groupByPlace(ctx context.Context, announces []models.Announce) ([]digestGroup, error) {
+	var groups []digestGroup
+	for i, ann := range announces {
+		if i > 0 && ann.PlacePK == announces[i-1].PlacePK {
+			g := &groups[len(groups)-1]
+			g.Announces = append(g.Announces, ann)
+			continue
+		}
+		name, err := placeName(ctx, ann.PlacePK)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, digestGroup{name, []models.Announce{ann}})
+	}
+	return groups, nil
+}
+
+// placeName returns the name of a place as displayed on the index page.
+func placeName(ctx context.Context, placePK int) (string, error) {
+	place, err := models.SelectPlaceWherePK(ctx, placePK)
+	if err != nil {
+		return "", err
+	}
+	dpt, err := models.SelectDepartmentWherePK(ctx, place.DepartmentPK)
+	if err != nil {
+		return "", err
+	}
+	return formatPlace(place, dpt), nil
+}
+
+// formatPlace returns the name of place, which is in dpt.
+func formatPlace(place models.Place, dpt models.Department) string {
+	switch {
+	case place.City != "":
+		return place.City + " / " + dpt.Name
+	case place.Arrondissement != "":
+		return dpt.Name + " " + place.Arrondissement
+	}
+	return dpt.Name
+}
@@ -0,0 +1,204 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the headers signed when DKIMSigner.Headers is nil.
+var DefaultDKIMHeaders = []string{
+	"From", "To", "Subject", "Date", "Message-ID", "MIME-Version",
+	"Content-Type", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// A DKIMSigner adds a DKIM-Signature header (RFC 6376) to messages, with the
+// relaxed/relaxed canonicalization. Key is an *rsa.PrivateKey, for
+// rsa-sha256, or an ed25519.PrivateKey, for ed25519-sha256 (RFC 8463).
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+	Headers  []string
+}
+
+// LoadDKIMKey reads a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519
+// (PKCS #8) private key.
+func LoadDKIMKey(filename string) (crypto.Signer, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("email: no PEM data in %s", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("email: unsupported key type %T in %s", key, filename)
+}
+
+// Sign returns msg, which must use CRLF line endings, with a DKIM-Signature
+// header prepended.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	var algorithm string
+	var opts crypto.SignerOpts
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		algorithm, opts = "rsa-sha256", crypto.SHA256
+	case ed25519.PrivateKey:
+		algorithm, opts = "ed25519-sha256", crypto.Hash(0)
+	default:
+		return nil, fmt.Errorf("email: unsupported DKIM key type %T", s.Key)
+	}
+
+	header, body := msg, []byte(nil)
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	fields := parseHeader(header)
+
+	names := s.Headers
+	if names == nil {
+		names = DefaultDKIMHeaders
+	}
+	signed := new(bytes.Buffer)
+	var h []string
+	used := make(map[int]bool)
+	for _, name := range names {
+		// Sign the last unused instance of the header, as a verifier
+		// would select it.
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].name, name) {
+				continue
+			}
+			used[i] = true
+			signed.WriteString(relaxedHeader(fields[i].name, fields[i].value))
+			signed.WriteString("\r\n")
+			h = append(h, strings.ToLower(name))
+			break
+		}
+	}
+	if !contains(h, "from") {
+		return nil, errors.New("email: DKIM requires a From header")
+	}
+
+	value := "v=1; a=" + algorithm + "; c=relaxed/relaxed; d=" + s.Domain +
+		"; s=" + s.Selector + "; t=" + strconv.FormatInt(time.Now().Unix(), 10) +
+		"; h=" + strings.Join(h, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	signed.WriteString(relaxedHeader("DKIM-Signature", value))
+
+	digest := sha256.Sum256(signed.Bytes())
+	sig, err := s.Key.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Folding doesn't change the relaxed canonicalization of the header.
+	out := new(bytes.Buffer)
+	writeHeader(out, "DKIM-Signature", value+base64.StdEncoding.EncodeToString(sig))
+	out.Write(msg)
+	return out.Bytes(), nil
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+// parseHeader splits a header in fields, keeping folded values as is.
+func parseHeader(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		fields = append(fields, headerField{line[:i], line[i+1:]})
+	}
+	return fields
+}
+
+// relaxedHeader canonicalizes a header field as described in RFC 6376
+// section 3.4.2, without the trailing CRLF.
+func relaxedHeader(name, value string) string {
+	value = strings.NewReplacer("\r\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(compressWSP(value))
+}
+
+// relaxedBody canonicalizes a body as described in RFC 6376 section 3.4.4.
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressWSP(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP replaces sequences of spaces and tabs with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	wsp := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			b.WriteByte(' ')
+			wsp = false
+		}
+		b.WriteRune(r)
+	}
+	if wsp {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
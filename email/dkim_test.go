@@ -0,0 +1,194 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// verifyDKIM verifies the first DKIM-Signature of msg with pub, with the
+// relaxed/relaxed canonicalization. It is written from RFC 6376 and does
+// not share the canonicalization code of the signer.
+func verifyDKIM(msg []byte, pub crypto.PublicKey) error {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return errors.New("no body")
+	}
+	header, body := string(msg[:i+2]), string(msg[i+4:])
+
+	// Unfold the header in fields.
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	wsp := regexp.MustCompile(`[ \t]+`)
+	canonHeader := func(field string) string {
+		name, value, _ := strings.Cut(field, ":")
+		value = strings.ReplaceAll(value, "\r\n", "")
+		value = strings.Trim(wsp.ReplaceAllString(value, " "), " ")
+		return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value
+	}
+
+	var sigField string
+	for _, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f), "dkim-signature:") {
+			sigField = f
+			break
+		}
+	}
+	if sigField == "" {
+		return errors.New("no DKIM-Signature")
+	}
+	tags := make(map[string]string)
+	_, value, _ := strings.Cut(sigField, ":")
+	for _, tag := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(k)] = regexp.MustCompile(`[ \t\r\n]`).ReplaceAllString(v, "")
+	}
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return fmt.Errorf("unexpected tags %v", tags)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(body, "\r\n") {
+		lines = append(lines, strings.TrimRight(wsp.ReplaceAllString(line, " "), " "))
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	canonBody := ""
+	if len(lines) > 0 {
+		canonBody = strings.Join(lines, "\r\n") + "\r\n"
+	}
+	bh := sha256.Sum256([]byte(canonBody))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	// Select the header fields from the bottom up.
+	h := new(bytes.Buffer)
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(strings.TrimSpace(strings.SplitN(fields[i], ":", 2)[0]), name) {
+				continue
+			}
+			used[i] = true
+			h.WriteString(canonHeader(fields[i]) + "\r\n")
+			break
+		}
+	}
+	b := regexp.MustCompile(`(b=)[^;]*$`).ReplaceAllString(canonHeader(sigField), "$1")
+	h.WriteString(b)
+	digest := sha256.Sum256(h.Bytes())
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("got a=%s", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("got a=%s", tags["a"])
+		}
+		if !ed25519.Verify(pub, digest[:], sig) {
+			return errors.New("ed25519: invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key %T", pub)
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := testMessage().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		t.Run(fmt.Sprintf("%T", key), func(t *testing.T) {
+			s := &DKIMSigner{Domain: "example.com", Selector: "pollbc", Key: key}
+			signed, err := s.Sign(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(signed, msg) {
+				t.Fatal("the message is changed")
+			}
+			err = verifyDKIM(signed, key.Public())
+			if err != nil {
+				t.Fatalf("valid signature: %v", err)
+			}
+
+			for _, tt := range []struct {
+				name   string
+				modify func(string) string
+				valid  bool
+			}{
+				// Relays may change whitespace, which the relaxed
+				// canonicalization ignores.
+				{"refolded", func(m string) string {
+					return strings.Replace(m, "To: <bob@example.com>", "To:\t <bob@example.com>  \r\n ", 1)
+				}, true},
+				{"trailing blank lines", func(m string) string { return m + "\r\n\r\n" }, true},
+				{"body", func(m string) string {
+					return strings.Replace(m, "500 =E2=82=AC", "50 =E2=82=AC", 1)
+				}, false},
+				{"signed header", func(m string) string {
+					return strings.Replace(m, "To: <bob@example.com>", "To: <eve@example.com>", 1)
+				}, false},
+				{"added signed header", func(m string) string {
+					i := strings.Index(m, "\r\n\r\n")
+					return m[:i] + "\r\nSubject: hello" + m[i:]
+				}, false},
+			} {
+				modified := tt.modify(string(signed))
+				if modified == string(signed) {
+					t.Fatalf("%s: the message is not modified", tt.name)
+				}
+				err := verifyDKIM([]byte(modified), key.Public())
+				if (err == nil) != tt.valid {
+					t.Errorf("%s: got %v", tt.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMSignRequiresFrom(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s := &DKIMSigner{Domain: "example.com", Selector: "pollbc", Key: key}
+	_, err := s.Sign([]byte("To: bob@example.com\r\n\r\nbody\r\n"))
+	if err == nil {
+		t.Error("got no error")
+	}
+}
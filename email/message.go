@@ -0,0 +1,184 @@
+// Package email builds RFC 5322 email messages.
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Message is an email with a plain text body and an optional HTML
+// alternative.
+type Message struct {
+	From    mail.Address
+	To      []mail.Address
+	Subject string
+
+	// Date and MessageID are set by Bytes when they are zero.
+	Date      time.Time
+	MessageID string
+
+	// Header holds additional headers, such as List-Unsubscribe.
+	Header map[string]string
+
+	Text string
+	HTML string
+}
+
+// Bytes returns the message with its headers, ready to be sent over SMTP.
+// Non-ASCII header values are encoded as described in RFC 2047, and bodies
+// are quoted-printable. When the message has an HTML body, it is a
+// multipart/alternative message whose boundary only depends on the bodies.
+func (m *Message) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := m.MessageID
+	if messageID == "" {
+		var err error
+		messageID, err = newMessageID(m.From.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var to []string
+	for _, addr := range m.To {
+		to = append(to, addr.String())
+	}
+
+	writeHeader(buf, "From", m.From.String())
+	writeHeader(buf, "To", strings.Join(to, ", "))
+	writeHeader(buf, "Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader(buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(buf, "Message-ID", messageID)
+	writeHeader(buf, "MIME-Version", "1.0")
+	var keys []string
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader(buf, textproto.CanonicalMIMEHeaderKey(k), mime.QEncoding.Encode("utf-8", m.Header[k]))
+	}
+
+	if m.HTML == "" {
+		writeHeader(buf, "Content-Type", "text/plain; charset=utf-8")
+		writeHeader(buf, "Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		err := writeQuotedPrintable(buf, m.Text)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n")) {
+			buf.WriteString("\r\n")
+		}
+		return buf.Bytes(), nil
+	}
+
+	w := multipart.NewWriter(buf)
+	err := w.SetBoundary(boundary(m.Text, m.HTML))
+	if err != nil {
+		return nil, err
+	}
+	writeHeader(buf, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": w.Boundary()}))
+	buf.WriteString("\r\n")
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = writeQuotedPrintable(pw, part.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxLineLength is the length of header lines recommended by RFC 5322.
+const maxLineLength = 78
+
+// writeHeader writes a header field, folded before the spaces that keep its
+// lines within maxLineLength. Words longer than a line are not split.
+func writeHeader(buf *bytes.Buffer, key, value string) {
+	line := key + ": " + value
+	// first is the space before the first word of the line.
+	first := len(key) + 1
+	for len(line) > maxLineLength {
+		i := strings.LastIndexByte(line[:maxLineLength+1], ' ')
+		if i <= first {
+			// The first word is too long: move it to a line of its own
+			// if it fits there, or fold after it.
+			end := len(line)
+			if j := strings.IndexByte(line[first+1:], ' '); j >= 0 {
+				end = first + 1 + j
+			}
+			switch {
+			case first > 0 && end-first <= maxLineLength:
+				i = first
+			case end < len(line):
+				i = end
+			default:
+				buf.WriteString(line + "\r\n")
+				return
+			}
+		}
+		buf.WriteString(line[:i] + "\r\n")
+		line = line[i:]
+		first = 0
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	_, err := io.WriteString(qp, s)
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func boundary(text, html string) string {
+	h := sha1.New()
+	io.WriteString(h, text)
+	io.WriteString(h, html)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newMessageID(from string) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%x@%s>", b, domain), nil
+}
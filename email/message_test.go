@@ -0,0 +1,173 @@
+package email
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func testMessage() *Message {
+	return &Message{
+		From:      mail.Address{Name: "pollbc", Address: "pollbc@example.com"},
+		To:        []mail.Address{{Address: "bob@example.com"}},
+		Subject:   "3 nouvelles annonces à Paris 11e, dont une colocation près de la place Léon Blum",
+		Date:      time.Date(2016, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60)),
+		MessageID: "<0123456789abcdef@example.com>",
+		Header: map[string]string{
+			"list-unsubscribe":      "<https://pollbc.example.com/unsubscribe?token=abc>",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+		Text: "Chambre meublée – 500 €\r\nhttp://www.leboncoin.fr/colocations/1.htm\r\n" +
+			strings.Repeat("une ligne bien trop longue pour tenir sur les 76 caractères du quoted-printable ", 2) + "\r\n",
+		HTML: "<p><a href=\"http://www.leboncoin.fr/colocations/1.htm\">Chambre meublée</a> – 500 €</p>\r\n",
+	}
+}
+
+func TestMessageGolden(t *testing.T) {
+	plain := testMessage()
+	plain.HTML = ""
+	plain.Header = nil
+	for _, tt := range []struct {
+		name string
+		msg  *Message
+	}{
+		{"alternative", testMessage()},
+		{"plain", plain},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.msg.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				err := os.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	m := testMessage()
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(b[:bytes.Index(b, []byte("\r\n\r\n"))]), "\r\n") {
+		if len(line) > maxLineLength && strings.Contains(strings.TrimSpace(line), " ") {
+			t.Errorf("header line of %d characters: %q", len(line), line)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != m.Subject {
+		t.Errorf("got subject %q, want %q", subject, m.Subject)
+	}
+	for key, want := range map[string]string{
+		"From":                  `"pollbc" <pollbc@example.com>`,
+		"To":                    "<bob@example.com>",
+		"Date":                  "Sun, 01 May 2016 12:30:00 +0200",
+		"Message-Id":            "<0123456789abcdef@example.com>",
+		"Mime-Version":          "1.0",
+		"List-Unsubscribe":      "<https://pollbc.example.com/unsubscribe?token=abc>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	} {
+		if got := msg.Header.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q", mediaType)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		// NextRawPart keeps the Content-Transfer-Encoding.
+		p, err := r.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("got part %q, want %q", got, want.contentType)
+		}
+		if got := p.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+			t.Errorf("got Content-Transfer-Encoding %q", got)
+		}
+		raw, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("quoted-printable line of %d characters", len(line))
+			}
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want.body {
+			t.Errorf("got body %q, want %q", body, want.body)
+		}
+	}
+	if _, err := r.NextPart(); err != io.EOF {
+		t.Errorf("got %v after the last part, want EOF", err)
+	}
+}
+
+func TestWriteHeaderFolds(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+	}{
+		{"short", "X-Test: short\r\n"},
+		{strings.Repeat("word ", 20) + "end",
+			"X-Test: word word word word word word word word word word word word word word\r\n" +
+				" word word word word word word end\r\n"},
+		// A word that fits on a line of its own is moved there.
+		{strings.Repeat("x", 72) + " end", "X-Test:\r\n " + strings.Repeat("x", 72) + " end\r\n"},
+		// A longer word is not split.
+		{strings.Repeat("x", 100), "X-Test: " + strings.Repeat("x", 100) + "\r\n"},
+		{strings.Repeat("x", 100) + " end", "X-Test: " + strings.Repeat("x", 100) + "\r\n end\r\n"},
+	} {
+		buf := new(bytes.Buffer)
+		writeHeader(buf, "X-Test", tt.value)
+		if buf.String() != tt.want {
+			t.Errorf("got\n%q\nwant\n%q", buf, tt.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// TLS modes of a Relay.
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "implicit"
+)
+
+// Authentication mechanisms of a Relay.
+const (
+	AuthNone    = "none"
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+)
+
+// A Relay is an SMTP server.
+type Relay struct {
+	Host string
+	// Port defaults to 465 with implicit TLS, 587 with STARTTLS and 25
+	// otherwise.
+	Port     string
+	TLS      string
+	Auth     string
+	Username string
+	Password string
+}
+
+func (r Relay) addr() string {
+	port := r.Port
+	if port == "" {
+		switch r.TLS {
+		case TLSImplicit:
+			port = "465"
+		case TLSStartTLS:
+			port = "587"
+		default:
+			port = "25"
+		}
+	}
+	return net.JoinHostPort(r.Host, port)
+}
+
+// A Transport sends messages through the first relay that accepts a
+// connection. It keeps an SMTP session open between messages, so it is
+// cheap to send many messages in a row. It is safe for concurrent use:
+// concurrent messages are sent in sessions of their own.
+type Transport struct {
+	// Relays are tried in order when connecting.
+	Relays []Relay
+	// Rate is the maximum number of messages sent per minute, or 0 for no
+	// limit.
+	Rate int
+	// Timeout bounds connecting to a relay and each SMTP command. It
+	// defaults to 30 seconds.
+	Timeout time.Duration
+	// DKIM, if not nil, signs messages.
+	DKIM *DKIMSigner
+
+	// mu guards idle and next. It is never held during network I/O.
+	mu   sync.Mutex
+	idle *session
+	next time.Time
+}
+
+// A session is an SMTP session with a relay.
+type session struct {
+	client *smtp.Client
+	conn   net.Conn
+	relay  Relay
+}
+
+// Send sends msg to its recipients. ctx bounds the whole sending: waiting
+// for the rate limit, connecting to a relay and the SMTP commands, which are
+// interrupted when ctx is done.
+func (t *Transport) Send(ctx context.Context, msg *Message) error {
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if t.DKIM != nil {
+		b, err = t.DKIM.Sign(b)
+		if err != nil {
+			return err
+		}
+	}
+	var to []string
+	for _, addr := range msg.To {
+		to = append(to, addr.Address)
+	}
+
+	err = t.wait(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := t.session(ctx)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { s.conn.SetDeadline(time.Now()) })
+	err = t.send(ctx, s, msg.From.Address, to, b)
+	interrupted := !stop()
+	if err != nil {
+		// The session is in an unknown state.
+		s.client.Close()
+		if interrupted {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("email: %s: %w", s.relay.Host, err)
+	}
+	if interrupted {
+		// The message was sent, but the deadline of the session is in
+		// the past.
+		s.client.Close()
+		return nil
+	}
+	t.put(s)
+	return nil
+}
+
+// Close ends the idle SMTP session, if any.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	s := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.conn.SetDeadline(time.Now().Add(t.timeout()))
+	return s.client.Quit()
+}
+
+func (t *Transport) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return t.Timeout
+}
+
+// deadline sets the deadline of the next SMTP command on s.
+func (t *Transport) deadline(ctx context.Context, s *session) {
+	d := time.Now().Add(t.timeout())
+	if ctxd, ok := ctx.Deadline(); ok && ctxd.Before(d) {
+		d = ctxd
+	}
+	s.conn.SetDeadline(d)
+	if ctx.Err() != nil {
+		// ctx was done before or while the deadline was set.
+		s.conn.SetDeadline(time.Now())
+	}
+}
+
+// wait reserves the next slot allowed by Rate and sleeps until then, or
+// until ctx is done.
+func (t *Transport) wait(ctx context.Context) error {
+	if t.Rate <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	slot := t.next
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	t.next = slot.Add(time.Minute / time.Duration(t.Rate))
+	t.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	return nil
+}
+
+// session takes the idle session, if it is still alive, or opens a new one.
+func (t *Transport) session(ctx context.Context) (*session, error) {
+	t.mu.Lock()
+	s := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	if s != nil {
+		t.deadline(ctx, s)
+		if s.client.Noop() == nil {
+			return s, nil
+		}
+		// The relay closed the idle session.
+		s.client.Close()
+	}
+	return t.connect(ctx)
+}
+
+// put keeps s for the next message, unless another session is already
+// kept.
+func (t *Transport) put(s *session) {
+	t.mu.Lock()
+	if t.idle == nil {
+		t.idle = s
+		s = nil
+	}
+	t.mu.Unlock()
+	if s != nil {
+		s.conn.SetDeadline(time.Now().Add(t.timeout()))
+		s.client.Quit()
+	}
+}
+
+func (t *Transport) send(ctx context.Context, s *session, from string, to []string, msg []byte) error {
+	t.deadline(ctx, s)
+	err := s.client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		t.deadline(ctx, s)
+		err = s.client.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	t.deadline(ctx, s)
+	w, err := s.client.Data()
+	if err != nil {
+		return err
+	}
+	t.deadline(ctx, s)
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	t.deadline(ctx, s)
+	return s.client.Reset()
+}
+
+// connect opens a session with the first relay that works.
+func (t *Transport) connect(ctx context.Context) (*session, error) {
+	if len(t.Relays) == 0 {
+		return nil, errors.New("email: no relay")
+	}
+	var errs []error
+	for _, relay := range t.Relays {
+		s, err := t.dial(ctx, relay)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", relay.Host, err))
+			continue
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("email: no relay available: %v", errors.Join(errs...))
+}
+
+func (t *Transport) dial(ctx context.Context, relay Relay) (*session, error) {
+	tlsConfig := &tls.Config{ServerName: relay.Host}
+	dialer := &net.Dialer{Timeout: t.timeout()}
+
+	var conn net.Conn
+	var err error
+	if relay.TLS == TLSImplicit {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", relay.addr())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", relay.addr())
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &session{conn: conn, relay: relay}
+	// The greeting, STARTTLS and AUTH are bounded together.
+	t.deadline(ctx, s)
+	client, err := smtp.NewClient(conn, relay.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.client = client
+	if relay.TLS == TLSStartTLS {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	var auth smtp.Auth
+	switch relay.Auth {
+	case "", AuthNone:
+	case AuthPlain:
+		auth = smtp.PlainAuth("", relay.Username, relay.Password, relay.Host)
+	case AuthLogin:
+		auth = &loginAuth{relay.Username, relay.Password}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(relay.Username, relay.Password)
+	default:
+		client.Close()
+		return nil, fmt.Errorf("unknown auth %q", relay.Auth)
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp lacks.
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
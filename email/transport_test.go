@@ -0,0 +1,196 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay is an SMTP server that accepts every message, or stops
+// answering once it receives the command stall.
+type fakeRelay struct {
+	net.Listener
+	stall string
+
+	mu       sync.Mutex
+	conns    int
+	messages int
+}
+
+func newFakeRelay(t *testing.T, stall string) *fakeRelay {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRelay{Listener: l, stall: stall}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns++
+			r.mu.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRelay) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 fake")
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		if cmd == r.stall {
+			// Keep the connection open without answering.
+			br.ReadString(0)
+			return
+		}
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			r.mu.Lock()
+			r.messages++
+			r.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (r *fakeRelay) relay() Relay {
+	host, port, _ := net.SplitHostPort(r.Addr().String())
+	return Relay{Host: host, Port: port}
+}
+
+func testTransportMessage() *Message {
+	return &Message{
+		From:    mail.Address{Address: "pollbc@example.com"},
+		To:      []mail.Address{{Address: "bob@example.com"}},
+		Subject: "test",
+		Text:    "test\r\n",
+	}
+}
+
+func TestTransportKeepsSession(t *testing.T) {
+	r := newFakeRelay(t, "")
+	tr := &Transport{Relays: []Relay{r.relay()}, Timeout: time.Second}
+	for i := 0; i < 3; i++ {
+		err := tr.Send(context.Background(), testTransportMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns != 1 || r.messages != 3 {
+		t.Errorf("got %d messages in %d sessions, want 3 in 1", r.messages, r.conns)
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	for _, stall := range []string{"EHLO", "MAIL", "DATA"} {
+		t.Run(stall, func(t *testing.T) {
+			r := newFakeRelay(t, stall)
+			tr := &Transport{Relays: []Relay{r.relay()}, Timeout: 100 * time.Millisecond}
+			start := time.Now()
+			err := tr.Send(context.Background(), testTransportMessage())
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("Send returned after %v", d)
+			}
+		})
+	}
+}
+
+func TestTransportContextDeadline(t *testing.T) {
+	r := newFakeRelay(t, "DATA")
+	tr := &Transport{Relays: []Relay{r.relay()}, Timeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := tr.Send(ctx, testTransportMessage())
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Send returned after %v", d)
+	}
+}
+
+func TestTransportRateDoesNotBlockOthers(t *testing.T) {
+	r := newFakeRelay(t, "")
+	tr := &Transport{Relays: []Relay{r.relay()}, Rate: 1, Timeout: time.Second}
+	err := tr.Send(context.Background(), testTransportMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The next slot is a minute away: a waiting sender must not keep
+	// Close from returning.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tr.Send(ctx, testTransportMessage()) }()
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() { tr.Close(); close(closed) }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Close is blocked by a sender waiting for the rate limit")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTransportCancel(t *testing.T) {
+	r := newFakeRelay(t, "DATA")
+	tr := &Transport{Relays: []Relay{r.relay()}, Timeout: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := tr.Send(ctx, testTransportMessage())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Send returned after %v", d)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/yansal/pollbc/models"
+)
+
+// A facet is a list of values that narrow down the announces of the index
+// page.
+type facet struct {
+	Title  string
+	Values []facetValue
+}
+
+type facetValue struct {
+	Label    string
+	Count    int
+	Selected bool
+	// Query is the query of the index page with the value toggled.
+	Query template.URL
+}
+
+// Parameters of the facets and of the navbar form of the index page.
+var (
+	facetParams = []string{"departmentPK", "placePK", "price", "keyword", "rentcap"}
+	formParams  = []string{"search", "from", "to", "sort"}
+)
+
+// indexFacets returns the facets of the index page. Places are listed for
+// the departments of the selection only.
+func indexFacets(q url.Values, f models.AnnounceFilter, groups []departmentPlaces, counts models.FacetCounts) []facet {
+	var facets []facet
+
+	dpts := facet{Title: "Departments"}
+	shown := intSet(f.DepartmentPKs)
+	selectedPlaces := intSet(f.PlacePKs)
+	for _, g := range groups {
+		v := newFacetValue(q, "departmentPK", strconv.Itoa(g.Department.PK), g.Department.Name, counts.Departments[g.Department.PK])
+		if v.Count > 0 || v.Selected {
+			dpts.Values = append(dpts.Values, v)
+		}
+		for _, p := range g.Places {
+			if selectedPlaces[p.PK] {
+				shown[g.Department.PK] = true
+			}
+		}
+	}
+	facets = append(facets, dpts)
+
+	for _, g := range groups {
+		if !shown[g.Department.PK] {
+			continue
+		}
+		places := facet{Title: g.Department.Name}
+		for _, p := range g.Places {
+			label := p.City
+			if label == "" {
+				label = g.Department.Name + " " + p.Arrondissement
+			}
+			v := newFacetValue(q, "placePK", strconv.Itoa(p.PK), label, counts.Places[p.PK])
+			if v.Count > 0 || v.Selected {
+				places.Values = append(places.Values, v)
+			}
+		}
+		facets = append(facets, places)
+	}
+
+	prices := facet{Title: "Price"}
+	for i, r := range models.PriceBuckets {
+		prices.Values = append(prices.Values, newFacetValue(q, "price", formatPriceRange(r), priceRangeLabel(r), counts.Prices[i]))
+	}
+	facets = append(facets, prices)
+
+	keywords := facet{Title: "Keywords"}
+	for _, k := range facetKeywords(f) {
+		v := newFacetValue(q, "keyword", k, k, counts.Keywords[k])
+		if v.Count > 0 || v.Selected {
+			keywords.Values = append(keywords.Values, v)
+		}
+	}
+	facets = append(facets, keywords)
+
+	rent := facet{Title: "Rent control"}
+	v := newFacetValue(q, "rentcap", "above", "Above the rent cap", counts.AboveRentCap)
+	if v.Count > 0 || v.Selected {
+		rent.Values = append(rent.Values, v)
+	}
+	facets = append(facets, rent)
+	return facets
+}
+
+// facetKeywords returns the suggested keywords and the ones of f.
+func facetKeywords(f models.AnnounceFilter) []string {
+	keywords := append([]string(nil), models.Keywords...)
+	for _, k := range f.Keywords {
+		if !containsFold(keywords, k) {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+func containsFold(s []string, v string) bool {
+	for _, x := range s {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFacetValue(q url.Values, key, value, label string, count int) facetValue {
+	t := make(url.Values)
+	for k, v := range q {
+		if k != "cursor" {
+			t[k] = v
+		}
+	}
+	selected := false
+	var values []string
+	for _, v := range q[key] {
+		if v == value {
+			selected = true
+			continue
+		}
+		values = append(values, v)
+	}
+	if !selected {
+		values = append(values, value)
+	}
+	if len(values) > 0 {
+		t[key] = values
+	} else {
+		delete(t, key)
+	}
+	return facetValue{label, count, selected, template.URL(t.Encode())}
+}
+
+// formatPriceRange returns the value of r in the price parameter, such as
+// "400-600" or "1000-".
+func formatPriceRange(r models.PriceRange) string {
+	if r.Max == 0 {
+		return fmt.Sprintf("%d-", r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func parsePriceRange(s string) (models.PriceRange, error) {
+	var r models.PriceRange
+	split := strings.Split(s, "-")
+	if len(split) != 2 {
+		return r, fmt.Errorf("invalid price %q", s)
+	}
+	var err error
+	r.Min, err = strconv.Atoi(split[0])
+	if err != nil {
+		return r, fmt.Errorf("invalid price %q", s)
+	}
+	if split[1] != "" {
+		r.Max, err = strconv.Atoi(split[1])
+		if err != nil {
+			return r, fmt.Errorf("invalid price %q", s)
+		}
+	}
+	return r, nil
+}
+
+func priceRangeLabel(r models.PriceRange) string {
+	switch {
+	case r.Min == 0:
+		return fmt.Sprintf("Under %d €", r.Max)
+	case r.Max == 0:
+		return fmt.Sprintf("%d € and more", r.Min)
+	}
+	return fmt.Sprintf("%d – %d €", r.Min, r.Max)
+}
+
+type hiddenInput struct {
+	Name  string
+	Value string
+}
+
+// hiddenInputs returns the values of the params of q, for a form to keep
+// them.
+func hiddenInputs(q url.Values, params ...[]string) []hiddenInput {
+	var inputs []hiddenInput
+	for _, names := range params {
+		for _, name := range names {
+			for _, v := range q[name] {
+				inputs = append(inputs, hiddenInput{name, v})
+			}
+		}
+	}
+	return inputs
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+type feedItem struct {
+	ID      string
+	URL     string
+	Title   string
+	Summary string
+	Date    time.Time
+}
+
+// serveFeed serves the announces selected by the parameters of the index
+// page as RSS 2.0 (/feed/rss), Atom 1.0 (/feed/atom) or JSON Feed 1.1
+// (/feed/json).
+func (a *app) serveFeed(w http.ResponseWriter, r *http.Request) {
+	format := strings.TrimPrefix(r.URL.Path, "/feed/")
+	var contentType string
+	switch format {
+	case "rss":
+		contentType = "application/rss+xml; charset=utf-8"
+	case "atom":
+		contentType = "application/atom+xml; charset=utf-8"
+	case "json":
+		contentType = "application/feed+json; charset=utf-8"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := announceFilter(r, a.cfg.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	announces, err := models.SelectAnnouncesFilter(r.Context(), f)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var items []feedItem
+	var modified time.Time
+	etag := sha256.New()
+	fmt.Fprintln(etag, format)
+	for _, ann := range announces {
+		place, err := placeName(r.Context(), ann.PlacePK)
+		if err != nil {
+			logRequestError(r, err)
+		}
+		summary := place
+		if ann.Price != "" {
+			summary += " - " + ann.Price
+		}
+		items = append(items, feedItem{
+			ID:      announceID(ann),
+			URL:     ann.URL,
+			Title:   ann.Title,
+			Summary: summary,
+			Date:    ann.Date,
+		})
+		if ann.Fetched.After(modified) {
+			modified = ann.Fetched
+		}
+		fmt.Fprintln(etag, ann.PK, ann.Fetched.Unix())
+	}
+	if len(announces) == 0 {
+		// An empty feed is up to date as of the last poll.
+		modified, err = models.SelectLastUpdate(r.Context())
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		// The Atom feed is updated at modified.
+		fmt.Fprintln(etag, modified.Unix())
+	}
+
+	title := "pollbc"
+	if f.Search != "" {
+		title += ": " + f.Search
+	}
+	link := a.cfg.BaseURL + "/"
+	if r.URL.RawQuery != "" {
+		link += "?" + r.URL.RawQuery
+	}
+	self := a.cfg.BaseURL + r.URL.RequestURI()
+
+	var body []byte
+	switch format {
+	case "rss":
+		body, err = rssFeed(title, link, items)
+	case "atom":
+		body, err = atomFeed(title, link, self, modified, items)
+	case "json":
+		body, err = jsonFeed(title, link, self, items)
+	}
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(etag.Sum(nil))+`"`)
+	// ServeContent handles If-None-Match and If-Modified-Since.
+	http.ServeContent(w, r, "", modified, bytes.NewReader(body))
+}
+
+// announceID returns a tag URI (RFC 4151) that identifies ann for ever.
+func announceID(ann models.Announce) string {
+	return fmt.Sprintf("tag:pollbc.herokuapp.com,2015:announce/%d", ann.PK)
+}
+
+func rssFeed(title, link string, items []feedItem) ([]byte, error) {
+	type guid struct {
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+		Value       string `xml:",chardata"`
+	}
+	type item struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		Description string `xml:"description"`
+		GUID        guid   `xml:"guid"`
+		PubDate     string `xml:"pubDate"`
+	}
+	type channel struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		Description string `xml:"description"`
+		Items       []item `xml:"item"`
+	}
+	feed := struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel channel  `xml:"channel"`
+	}{Version: "2.0", Channel: channel{Title: title, Link: link, Description: "New announces from leboncoin.fr"}}
+	for _, it := range items {
+		feed.Channel.Items = append(feed.Channel.Items, item{
+			Title:       it.Title,
+			Link:        it.URL,
+			Description: it.Summary,
+			GUID:        guid{false, it.ID},
+			PubDate:     it.Date.Format(time.RFC1123Z),
+		})
+	}
+	return marshalXML(feed)
+}
+
+func atomFeed(title, link, self string, updated time.Time, items []feedItem) ([]byte, error) {
+	type atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+	type entry struct {
+		ID      string   `xml:"id"`
+		Title   string   `xml:"title"`
+		Link    atomLink `xml:"link"`
+		Summary string   `xml:"summary"`
+		Updated string   `xml:"updated"`
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed := struct {
+		XMLName xml.Name   `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string     `xml:"id"`
+		Title   string     `xml:"title"`
+		Updated string     `xml:"updated"`
+		Author  string     `xml:"author>name"`
+		Links   []atomLink `xml:"link"`
+		Entries []entry    `xml:"entry"`
+	}{
+		ID:      self,
+		Title:   title,
+		Updated: updated.Format(time.RFC3339),
+		Author:  "pollbc",
+		Links:   []atomLink{{link, "alternate"}, {self, "self"}},
+	}
+	for _, it := range items {
+		feed.Entries = append(feed.Entries, entry{
+			ID:      it.ID,
+			Title:   it.Title,
+			Link:    atomLink{Href: it.URL},
+			Summary: it.Summary,
+			Updated: it.Date.Format(time.RFC3339),
+		})
+	}
+	return marshalXML(feed)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func jsonFeed(title, link, self string, items []feedItem) ([]byte, error) {
+	type item struct {
+		ID            string `json:"id"`
+		URL           string `json:"url"`
+		Title         string `json:"title"`
+		ContentText   string `json:"content_text"`
+		DatePublished string `json:"date_published"`
+	}
+	feed := struct {
+		Version     string `json:"version"`
+		Title       string `json:"title"`
+		HomePageURL string `json:"home_page_url"`
+		FeedURL     string `json:"feed_url"`
+		Items       []item `json:"items"`
+	}{"https://jsonfeed.org/version/1.1", title, link, self, []item{}}
+	for _, it := range items {
+		feed.Items = append(feed.Items, item{it.ID, it.URL, it.Title, it.Summary, it.Date.Format(time.RFC3339)})
+	}
+	return json.MarshalIndent(feed, "", "\t")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeFeed makes the models answer announces, in Paris, and lastUpdate
+// for the time of the last poll.
+func useFakeFeed(t *testing.T, announces [][]driver.Value, lastUpdate time.Time) *fakeDB {
+	fake := useFakeDB(t)
+	fake.answer = func(query string, args []driver.NamedValue) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "GREATEST"):
+			if lastUpdate.IsZero() {
+				return [][]driver.Value{{nil}}
+			}
+			return [][]driver.Value{{lastUpdate}}
+		case strings.Contains(query, "FROM pollbc_places"):
+			return [][]driver.Value{{int64(1), "", "11e", int64(75)}}
+		case strings.Contains(query, "FROM pollbc_departements"):
+			return [][]driver.Value{{int64(75), "Paris", int64(1)}}
+		}
+		return announces
+	}
+	return fake
+}
+
+func serveFeed(t *testing.T, path string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", path, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	newTestApp(t).serveFeed(w, r)
+	return w
+}
+
+func TestFeedConditionalGET(t *testing.T) {
+	fetched := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	useFakeFeed(t, [][]driver.Value{announceRow(2, fetched), announceRow(1, fetched.Add(-time.Hour))}, time.Time{})
+	etags := make(map[string]string)
+	for format, contentType := range map[string]string{
+		"rss":  "application/rss+xml; charset=utf-8",
+		"atom": "application/atom+xml; charset=utf-8",
+		"json": "application/feed+json; charset=utf-8",
+	} {
+		path := "/feed/" + format
+		w := serveFeed(t, path, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Fatalf("%s: got %d %q, want 200 %q", format, w.Code, w.Header().Get("Content-Type"), contentType)
+		}
+		if !strings.Contains(w.Body.String(), "tag:pollbc.herokuapp.com,2015:announce/2") {
+			t.Errorf("%s: got %s, want the announces", format, w.Body)
+		}
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("%s: got no ETag", format)
+		}
+		etags[etag] = format
+		if got := w.Header().Get("Last-Modified"); got != fetched.Format(http.TimeFormat) {
+			t.Errorf("%s: got Last-Modified %q, want the newest fetch", format, got)
+		}
+
+		for _, tt := range []struct {
+			header http.Header
+			want   int
+		}{
+			{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+			{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+			{http.Header{"If-Modified-Since": {fetched.Format(http.TimeFormat)}}, http.StatusNotModified},
+			{http.Header{"If-Modified-Since": {fetched.Add(-time.Second).Format(http.TimeFormat)}}, http.StatusOK},
+			// If-None-Match takes precedence.
+			{http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {fetched.Format(http.TimeFormat)}}, http.StatusOK},
+		} {
+			w := serveFeed(t, path, tt.header)
+			if w.Code != tt.want {
+				t.Errorf("%s %v: got %d, want %d", format, tt.header, w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("%s %v: got body %s, want none", format, tt.header, w.Body)
+			}
+		}
+	}
+	if len(etags) != 3 {
+		t.Errorf("got ETags %v, want one per format", etags)
+	}
+}
+
+func TestFeedEmpty(t *testing.T) {
+	lastUpdate := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	useFakeFeed(t, nil, lastUpdate)
+	w := serveFeed(t, "/feed/atom?search=nothing", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Last-Modified"); got != lastUpdate.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want the last update", got)
+	}
+	if !strings.Contains(w.Body.String(), "<updated>2016-05-01T12:00:00Z</updated>") {
+		t.Errorf("got %s, want the feed updated at the last update", w.Body)
+	}
+	etag := w.Header().Get("ETag")
+
+	w = serveFeed(t, "/feed/atom?search=nothing", http.Header{"If-Modified-Since": {lastUpdate.Format(http.TimeFormat)}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got %d, want 304", w.Code)
+	}
+
+	// The Atom feed changes with the time of the last update.
+	useFakeFeed(t, nil, lastUpdate.Add(time.Hour))
+	w = serveFeed(t, "/feed/atom?search=nothing", http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d after another poll, want 200", w.Code)
+	}
+}
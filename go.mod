@@ -0,0 +1,3 @@
+module github.com/yansal/pollbc
+
+go 1.23
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/yansal/pollbc/config"
+	"github.com/yansal/pollbc/models"
+)
+
+// serveHealthz answers as long as the process is alive.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// serveReadyz reports the state of the database, of the polls and of the
+// outbox. It fails with 503 when the database is unreachable and, in
+// processes with the poller role, when the polls or the sources can't be
+// read, or when a source was not polled successfully for the
+// poll_stale_after setting. Only the current sources are reported.
+func (a *app) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	type database struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}
+	type poll struct {
+		Source      string     `json:"source"`
+		LastAttempt time.Time  `json:"last_attempt"`
+		LastSuccess *time.Time `json:"last_success"`
+		LastError   string     `json:"last_error,omitempty"`
+		Stale       bool       `json:"stale"`
+	}
+	type outbox struct {
+		Due    int        `json:"due"`
+		Oldest *time.Time `json:"oldest"`
+	}
+	resp := struct {
+		Status   string   `json:"status"`
+		Database database `json:"database"`
+		Polls    []poll   `json:"polls"`
+		Outbox   *outbox  `json:"outbox"`
+	}{Status: "ok", Polls: []poll{}}
+	w.Header().Set("Cache-Control", "no-store")
+
+	status := http.StatusOK
+	fail := func() {
+		status = http.StatusServiceUnavailable
+		resp.Status = "unavailable"
+	}
+
+	err := models.Ping(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		resp.Database.Error = err.Error()
+		fail()
+		apiJSON(w, status, resp)
+		return
+	}
+	resp.Database.OK = true
+
+	// The polls are up to the pollers only.
+	polling := a.cfg.Roles.Has(config.RolePoller)
+	failPolls := func() {
+		if polling {
+			fail()
+		}
+	}
+
+	polls, err := models.SelectPolls(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		failPolls()
+	}
+	last := make(map[string]models.Poll)
+	for _, p := range polls {
+		last[p.Source] = p
+	}
+	srcs, err := a.sources(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		failPolls()
+	}
+	for _, src := range srcs {
+		p, ok := last[src.Name]
+		v := poll{Source: src.Name, LastAttempt: p.LastAttempt, LastError: p.LastError}
+		if !p.LastSuccess.IsZero() {
+			v.LastSuccess = &p.LastSuccess
+		}
+		if ok {
+			v.Stale = time.Since(p.LastSuccess) > a.cfg.PollStaleAfter.Duration
+		} else {
+			// A source that was never polled is stale once the process
+			// had the time to poll it.
+			v.Stale = time.Since(started) > a.cfg.PollStaleAfter.Duration
+		}
+		if v.Stale {
+			failPolls()
+		}
+		resp.Polls = append(resp.Polls, v)
+	}
+
+	due, oldest, err := models.SelectOutboxBacklog(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+	} else {
+		resp.Outbox = &outbox{Due: due}
+		if !oldest.IsZero() {
+			resp.Outbox.Oldest = &oldest
+		}
+	}
+
+	apiJSON(w, status, resp)
+}
+
+// started is the time the process started.
+var started = time.Now()
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/config"
+)
+
+func TestReadyzFailsClosed(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.err = errors.New("relation pollbc_polls does not exist")
+	rec := httptest.NewRecorder()
+	newTestApp(t).serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var resp struct {
+		Status   string
+		Database struct{ OK bool }
+	}
+	err := json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "unavailable" || !resp.Database.OK {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestReadyzStalePolls(t *testing.T) {
+	fake := useFakeDB(t)
+	fake.answer = func(query string, args []driver.NamedValue) [][]driver.Value {
+		if strings.Contains(query, "FROM pollbc_polls") {
+			day := time.Now().Add(-24 * time.Hour)
+			return [][]driver.Value{{sourceName, day, day, ""}}
+		}
+		return nil
+	}
+	for _, tt := range []struct {
+		roles  config.Roles
+		status int
+	}{
+		{config.Roles{config.RoleWeb, config.RolePoller}, http.StatusServiceUnavailable},
+		{config.Roles{config.RolePoller}, http.StatusServiceUnavailable},
+		// The polls are up to other processes.
+		{config.Roles{config.RoleWeb}, http.StatusOK},
+		{config.Roles{config.RoleNotifier, config.RoleJanitor}, http.StatusOK},
+	} {
+		a := newTestApp(t)
+		a.cfg.Roles = tt.roles
+		rec := httptest.NewRecorder()
+		a.serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.roles.String(), rec.Code, tt.status)
+		}
+		var resp struct{ Polls []struct{ Stale bool } }
+		err := json.NewDecoder(rec.Body).Decode(&resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Polls) != 1 || !resp.Polls[0].Stale {
+			t.Errorf("%s: got polls %+v, want the stale poll reported", tt.roles.String(), resp.Polls)
+		}
+	}
+}
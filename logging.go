@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/yansal/pollbc/config"
+)
+
+// setupLogging makes the default logger write JSON or text at the level of
+// c, which was validated. The messages of the log package go through it
+// too.
+func setupLogging(c config.Log) {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if c.Format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newRunID returns a random identifier to correlate the messages of one
+// iteration of a loop.
+func newRunID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logRequestError logs an error that happened while serving r.
+func logRequestError(r *http.Request, err error) {
+	slog.Error("serving request", "err", err, "method", r.Method, "path", r.URL.Path)
+}
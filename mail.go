@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"net/mail"
+	"strings"
+	"text/template"
+
+	"github.com/yansal/pollbc/config"
+	"github.com/yansal/pollbc/email"
+)
+
+// setupMail configures the sender of emails and the SMTP relays from the
+// mail configuration, which was validated.
+func (a *app) setupMail() error {
+	c := a.cfg.Mail
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return err
+	}
+	transport := &email.Transport{Rate: c.Rate}
+
+	relays := []config.SMTP{c.SMTP}
+	if c.Fallback.Server != "" {
+		relays = append(relays, c.Fallback)
+	}
+	for _, relay := range relays {
+		transport.Relays = append(transport.Relays, email.Relay{
+			Host:     relay.Server,
+			Port:     relay.Port,
+			TLS:      relay.TLS,
+			Auth:     relay.Auth,
+			Username: relay.Login,
+			Password: relay.Password,
+		})
+	}
+	if c.DKIM.KeyFile != "" {
+		key, err := email.LoadDKIMKey(c.DKIM.KeyFile)
+		if err != nil {
+			return err
+		}
+		domain := c.DKIM.Domain
+		if domain == "" {
+			domain = from.Address[strings.LastIndex(from.Address, "@")+1:]
+		}
+		transport.DKIM = &email.DKIMSigner{Domain: domain, Selector: c.DKIM.Selector, Key: key}
+	}
+	a.mailFrom, a.mailTransport = *from, transport
+	return nil
+}
+
+// newMessage renders an email from the address from to the address to. textFile defines the
+// "subject" template and its body is the text part of the email. htmlFile,
+// if not empty, is the HTML part.
+func newMessage(from mail.Address, to, textFile, htmlFile string, data interface{}) (*email.Message, error) {
+	t := template.Must(template.ParseFiles(textFile))
+	subject := new(bytes.Buffer)
+	err := t.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	text := new(bytes.Buffer)
+	err = t.Execute(text, data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &email.Message{
+		From:    from,
+		To:      []mail.Address{{Address: to}},
+		Subject: subject.String(),
+		Text:    text.String(),
+	}
+	if htmlFile != "" {
+		t := htmltemplate.Must(htmltemplate.ParseFiles(htmlFile))
+		html := new(bytes.Buffer)
+		err = t.Execute(html, data)
+		if err != nil {
+			return nil, err
+		}
+		msg.HTML = html.String()
+	}
+	return msg, nil
+}
+
+// sendMail renders textFile, as described by newMessage, and sends it to the
+// address to.
+func (a *app) sendMail(ctx context.Context, to, textFile string, data interface{}) error {
+	msg, err := newMessage(a.mailFrom, to, textFile, "", data)
+	if err != nil {
+		return err
+	}
+	return a.mailTransport.Send(ctx, msg)
+}
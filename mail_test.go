@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestSetupMail(t *testing.T) {
+	a, b := newTestApp(t), newTestApp(t)
+	a.cfg.Mail.From = "pollbc <pollbc@example.com>"
+	a.cfg.Mail.SMTP.Server = "smtp.example.com"
+	a.cfg.Mail.Fallback.Server = "fallback.example.com"
+	a.cfg.Mail.Rate = 10
+	b.cfg.Mail.From = "other@example.org"
+	b.cfg.Mail.SMTP.Server = "smtp.example.org"
+	for _, app := range []*app{a, b} {
+		err := app.setupMail()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.mailFrom.Address != "pollbc@example.com" || len(a.mailTransport.Relays) != 2 || a.mailTransport.Rate != 10 {
+		t.Errorf("got %v, %+v", a.mailFrom, a.mailTransport)
+	}
+	// Each app sends with its own configuration.
+	if b.mailFrom.Address != "other@example.org" || len(b.mailTransport.Relays) != 1 || b.mailTransport.Relays[0].Host != "smtp.example.org" {
+		t.Errorf("got %v, %+v", b.mailFrom, b.mailTransport)
+	}
+}
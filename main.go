@@ -1,305 +1,571 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/smtp"
-	"os"
-	"sort"
-	"strconv"
+	"net/mail"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/yansal/pollbc/config"
+	"github.com/yansal/pollbc/email"
 	"github.com/yansal/pollbc/models"
 )
 
-func init() {
-	models.InitDB(os.Getenv("DATABASE_URL"))
+// An app runs the roles and the commands of pollbc with its configuration.
+type app struct {
+	cfg *config.Config
+	// mailFrom and mailTransport send the emails, once setupMail
+	// configured them.
+	mailFrom      mail.Address
+	mailTransport *email.Transport
 }
 
-var paris *time.Location
-
-func init() {
-	var err error
-	paris, err = time.LoadLocation("Europe/Paris")
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func poll() {
+// poll fetches the announces of the sources until ctx is done. The
+// announces of the page being parsed when ctx is done are inserted before
+// poll returns.
+func (a *app) poll(ctx context.Context) {
 	for {
-		doc, err := fetch()
+		srcs, err := a.sources(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		interval := a.cfg.PollInterval.Duration
 		if err != nil {
-			log.Print(err)
-			time.Sleep(time.Minute)
-			continue
+			slog.Error("selecting sources", "err", err)
+			interval = a.cfg.PollRetryInterval.Duration
 		}
-		nodes := queryAnnounces(doc)
-
-		var newAnnounces []models.Announce
-		for _, n := range nodes {
-			place, dpt, err := queryPlace(n)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-
-			var ok bool
-			ok, err = models.HasDepartment(dpt)
-			if err != nil {
-				log.Print(err)
-			} else if !ok {
-				err := models.InsertDepartment(dpt)
-				if err != nil {
-					log.Print(err)
-				}
-			}
-			dptPK, err := models.SelectPKFromDepartment(dpt)
-			if err != nil {
-				log.Print(err)
-			}
-			place.DepartmentPK = dptPK
-
-			ok, err = models.HasPlace(place)
-			if err != nil {
-				log.Print(err)
-			} else if !ok {
-				err := models.InsertPlace(place)
-				if err != nil {
-					log.Print(err)
-				}
-			}
-			placePK, err := models.SelectPKFromPlaces(place)
-			if err != nil {
-				log.Print(err)
-			}
-
-			url, err := queryURL(n)
-			if err != nil {
-				log.Print(err)
-				continue
+		for _, src := range srcs {
+			if !a.pollSource(ctx, src) {
+				interval = a.cfg.PollRetryInterval.Duration
 			}
-			ok, err = models.HasAnnounce(url)
-			if err != nil {
-				log.Print(err)
-			} else if !ok {
-				ann := models.Announce{URL: url, Fetched: time.Now().In(paris)}
-				ann.Date, err = queryDate(n)
-				if err != nil {
-					log.Print(err)
-					continue
-				}
-				ann.PlacePK = placePK
-				ann.Price = queryPrice(n)
-				ann.Title = queryTitle(n)
-				err := models.InsertAnnounce(ann)
-				if err != nil {
-					log.Print(err)
-					continue
-				}
-				newAnnounces = append(newAnnounces, ann)
+			if ctx.Err() != nil {
+				return
 			}
 		}
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
 
-		if len(newAnnounces) > 0 {
-			log.Printf("Number of new announces fetched:\t%d", len(newAnnounces))
-			go notify(newAnnounces)
+// pollSource fetches the announces of src and inserts the new ones, unless
+// another poller just did. It returns false if src couldn't be fetched.
+func (a *app) pollSource(ctx context.Context, src models.Source) bool {
+	work := context.WithoutCancel(ctx)
+	logger := slog.With("run", newRunID(), "source", src.Name)
+	ok, err := models.ClaimPoll(ctx, src.Name, a.cfg.PollInterval.Duration, a.cfg.PollRetryInterval.Duration)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("claiming poll", "err", err)
 		}
-		time.Sleep(5 * time.Second)
+		return false
+	}
+	if !ok {
+		logger.Debug("polled by another process")
+		return true
+	}
+	parsed, err := a.fetchAnnounces(ctx, logger, src)
+	if ctx.Err() != nil {
+		return true
+	}
+	if err := models.RecordPoll(work, src.Name, err); err != nil {
+		logger.Error("recording poll", "err", err)
 	}
+	if err != nil {
+		logger.Error("fetching announces", "err", err, "url", src.URL)
+		return false
+	}
+	newAnnounces := a.storeAnnounces(work, logger, parsed)
+	logger.Info("polled", "announces", len(parsed), "new", len(newAnnounces))
+	return true
 }
 
-var (
-	smtpLogin    = os.Getenv("MAILGUN_SMTP_LOGIN")
-	smtpPassword = os.Getenv("MAILGUN_SMTP_PASSWORD")
-	smtpServer   = os.Getenv("MAILGUN_SMTP_SERVER")
-	smtpPort     = os.Getenv("MAILGUN_SMTP_PORT")
-)
+// A parsedAnnounce is an announce read from a source, with its place and
+// department, which are not in the database yet.
+type parsedAnnounce struct {
+	models.Announce
+	Place      models.Place
+	Department models.Department
+}
+
+var errNoAnnounces = errors.New("no announces found")
 
-func notify(announces []models.Announce) {
-	users, err := models.SelectUsers()
+// fetchAnnounces fetches the page of src and parses its announces. The
+// announces that can't be parsed are logged and skipped.
+func (a *app) fetchAnnounces(ctx context.Context, logger *slog.Logger, src models.Source) ([]parsedAnnounce, error) {
+	doc, err := fetch(ctx, &http.Client{Timeout: a.cfg.FetchTimeout.Duration}, src)
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, err
 	}
-	for _, user := range users {
-		placePK, err := models.SelectPlacesPKWhereUserPK(user.PK)
+	nodes := queryAnnounces(doc)
+	nodesParsed.Add(float64(len(nodes)))
+	if len(nodes) == 0 {
+		// The page is never empty: it changed, or it is an error page.
+		return nil, errNoAnnounces
+	}
+
+	var parsed []parsedAnnounce
+	for _, n := range nodes {
+		var p parsedAnnounce
+		p.Place, p.Department, err = queryPlace(n)
+		if err != nil {
+			logger.Warn("parsing place", "err", err)
+			parseErrors.Inc("place")
+			continue
+		}
+		p.URL, err = queryURL(n)
 		if err != nil {
-			log.Print(err)
+			logger.Warn("parsing url", "err", err)
+			parseErrors.Inc("url")
 			continue
 		}
-		var userAnnounces []models.Announce
-		for _, ann := range announces {
-			for _, pk := range placePK {
-				if ann.PlacePK == pk {
-					userAnnounces = append(userAnnounces, ann)
-				}
+		p.Date, err = queryDate(n, a.cfg.Location)
+		if err != nil {
+			logger.Warn("parsing date", "err", err, "url", p.URL)
+			parseErrors.Inc("date")
+			continue
+		}
+		p.Fetched = time.Now().In(a.cfg.Location)
+		p.Price = queryPrice(n)
+		p.PriceValue = models.ParsePrice(p.Price)
+		p.Title = queryTitle(n)
+		checkRentControl(&p.Announce, p.Place, p.Department)
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// storeAnnounces inserts the departments, places and announces of parsed
+// that are new, and returns the new announces.
+func (a *app) storeAnnounces(ctx context.Context, logger *slog.Logger, parsed []parsedAnnounce) []models.Announce {
+	var newAnnounces []models.Announce
+	for _, p := range parsed {
+		place, dpt := p.Place, p.Department
+		ok, err := models.HasDepartment(ctx, dpt)
+		if err != nil {
+			logger.Error("selecting department", "err", err, "department", dpt.Name)
+		} else if !ok {
+			err := models.InsertDepartment(ctx, dpt)
+			if err == models.ErrUnknownRegion {
+				// Its places can't be subscribed to by region.
+				logger.Warn("inserting department", "err", err, "department", dpt.Name)
+			} else if err != nil {
+				logger.Error("inserting department", "err", err, "department", dpt.Name)
 			}
 		}
-		if len(userAnnounces) > 0 {
-			data := struct {
-				User      models.User
-				Announces []models.Announce
-			}{user, userAnnounces}
-			t := template.Must(template.ParseFiles("template.mail.txt"))
-			buf := new(bytes.Buffer)
-			err := t.Execute(buf, data)
+		dptPK, err := models.SelectPKFromDepartment(ctx, dpt)
+		if err != nil {
+			logger.Error("selecting department", "err", err, "department", dpt.Name)
+		}
+		place.DepartmentPK = dptPK
+
+		ok, err = models.HasPlace(ctx, place)
+		if err != nil {
+			logger.Error("selecting place", "err", err, "city", place.City, "arrondissement", place.Arrondissement)
+		} else if !ok {
+			err := models.InsertPlace(ctx, place)
 			if err != nil {
-				log.Print(err)
-				continue
+				logger.Error("inserting place", "err", err, "city", place.City, "arrondissement", place.Arrondissement)
 			}
-			auth := smtp.PlainAuth("", smtpLogin, smtpPassword, smtpServer)
-			to := []string{user.Email}
-			msg := buf.Bytes()
-			err = smtp.SendMail(smtpServer+":"+smtpPort, auth, "yann@pollbc.herokuapp.com", to, msg)
+		}
+		placePK, err := models.SelectPKFromPlaces(ctx, place)
+		if err != nil {
+			logger.Error("selecting place", "err", err, "city", place.City, "arrondissement", place.Arrondissement)
+		}
+
+		ok, err = models.HasAnnounce(ctx, p.URL)
+		if err != nil {
+			logger.Error("selecting announce", "err", err, "url", p.URL)
+		} else if !ok {
+			ann := p.Announce
+			ann.PlacePK = placePK
+			ann.PK, err = models.InsertAnnounce(ctx, ann, a.cfg.Location)
 			if err != nil {
-				log.Print(err)
+				logger.Error("inserting announce", "err", err, "url", p.URL)
 				continue
 			}
-			log.Printf("Number of announces notified to %v:\t%v", user.Email, len(userAnnounces))
+			announcesInserted.Inc()
+			logger.Debug("new announce", "url", p.URL, "pk", ann.PK)
+			newAnnounces = append(newAnnounces, ann)
 		}
 	}
+	return newAnnounces
 }
 
-func deleteOldAnnounces() {
+// sleep waits for d. It returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (a *app) deleteOldAnnounces(ctx context.Context) {
 	for {
-		deleted, err := models.DeleteAnnounces()
-		if err != nil {
-			log.Print(err)
+		deleted, err := models.DeleteAnnounces(ctx, a.cfg.Retention.Duration)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("deleting old announces", "err", err)
 		}
+		announcesDeleted.Add(float64(deleted))
 		if deleted != 0 {
-			log.Printf("Number of old announces deleted:\t%d\n", deleted)
+			slog.Info("deleted old announces", "announces", deleted)
+		}
+		if !sleep(ctx, time.Minute) {
+			return
 		}
-		time.Sleep(time.Minute)
 	}
 }
 
-func serveHTTP(w http.ResponseWriter, r *http.Request) {
-	var ann []models.Announce
-	var departments []models.Department
-	var places []models.Place
+func (a *app) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f, err := announceFilter(r, a.cfg.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := selectDepartmentPlaces(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+	}
 	dptMap := make(map[int]models.Department)
 	placesMap := make(map[int]models.Place)
-	printDpts := false
+	for _, g := range groups {
+		dptMap[g.Department.PK] = g.Department
+		for _, p := range g.Places {
+			placesMap[p.PK] = p
+		}
+	}
+	counts, err := models.SelectFacetCounts(r.Context(), f, facetKeywords(f))
+	if err != nil {
+		logRequestError(r, err)
+	}
 
-	q := map[string][]string(r.URL.Query())
-	placePKsQuery := q["placePK"]
-	departmentPKsQuery := q["departmentPK"]
+	f.Limit = a.cfg.PageSize
+	ann, err := models.SelectAnnouncesFilter(r.Context(), f)
+	if err != nil {
+		logRequestError(r, err)
+	}
+	lastPK, err := models.SelectLastAnnouncePK(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+	}
 
-	if placePKsQuery != nil {
-		for _, placePK := range placePKsQuery {
-			placePK, err := strconv.Atoi(placePK)
-			if err != nil {
-				log.Print(err)
-			}
-			dptPK, err := models.SelectDepartmentPKWherePK(placePK)
-			if err != nil {
-				log.Print(err)
-			}
-			dpt, err := models.SelectDepartmentWherePK(dptPK)
-			if err != nil {
-				log.Print(err)
-			}
-			departments = append(departments, dpt)
-			newAnn, err := models.SelectAnnouncesWherePlacePK(placePK)
-			if err != nil {
-				log.Print(err)
-			}
-			ann = append(ann, newAnn...)
-		}
-		for _, dpt := range departments {
-			departmentPlaces, err := models.SelectPlacesWhereDepartmentPK(dpt.PK)
-			if err != nil {
-				log.Print(err)
-			}
-			places = append(places, departmentPlaces...)
+	var views []announceView
+	for _, announce := range ann {
+		views = append(views, newAnnounceView(r.Context(), announce, placesMap, dptMap, a.cfg.Location))
+	}
+
+	q := r.URL.Query()
+	q.Del("cursor")
+	first := template.URL(q.Encode())
+	var next template.URL
+	if len(ann) == a.cfg.PageSize {
+		q.Set("cursor", encodeCursor(f.CursorOf(ann[len(ann)-1])))
+		next = template.URL(q.Encode())
+	}
+	order := f.Sort
+	if order == "" {
+		order = models.SortDate
+	}
+
+	data := struct {
+		Facets    []facet
+		Total     int
+		Filtered  bool
+		Hidden    []hiddenInput
+		AllHidden []hiddenInput
+		Announces []announceView
+		User      *models.User
+		Search    string
+		Query     template.URL
+		LastPK    int
+		Sort      string
+		From      string
+		To        string
+		First     template.URL
+		Next      template.URL
+		Paged     bool
+		// Live is true when new announces belong at the top of the page.
+		Live bool
+	}{
+		indexFacets(r.URL.Query(), f, groups, counts), counts.Total, len(first) > 0,
+		hiddenInputs(r.URL.Query(), facetParams), hiddenInputs(r.URL.Query(), facetParams, formParams),
+		views, nil, f.Search, template.URL(r.URL.RawQuery), lastPK,
+		order, r.FormValue("from"), r.FormValue("to"), first, next, f.After != nil,
+		f.After == nil && f.DateTo.IsZero() && (order == models.SortDate || order == models.SortFetched),
+	}
+	if user, ok := currentUser(r); ok {
+		data.User = &user
+	}
+	t := template.Must(template.ParseFiles("template.html"))
+	err = t.Execute(w, data)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+// An announceView is what template.html needs to render an announce.
+type announceView struct {
+	models.Announce
+	Place      models.Place
+	Department models.Department
+	Location   *time.Location
+}
+
+// newAnnounceView looks up the place and department of ann in places and
+// dpts, and in the database when they are missing from the maps. Its dates
+// are displayed in loc.
+func newAnnounceView(ctx context.Context, ann models.Announce, places map[int]models.Place, dpts map[int]models.Department, loc *time.Location) announceView {
+	place, ok := places[ann.PlacePK]
+	if !ok {
+		var err error
+		place, err = models.SelectPlaceWherePK(ctx, ann.PlacePK)
+		if err != nil {
+			slog.Error("selecting place", "err", err, "place", ann.PlacePK)
 		}
-		if places[0].City != "" {
-			sort.Sort(models.ByCity(places))
-		} else {
-			sort.Sort(models.ByArrondissement(places))
+		places[ann.PlacePK] = place
+	}
+	dpt, ok := dpts[place.DepartmentPK]
+	if !ok {
+		var err error
+		dpt, err = models.SelectDepartmentWherePK(ctx, place.DepartmentPK)
+		if err != nil {
+			slog.Error("selecting department", "err", err, "department", place.DepartmentPK)
 		}
-	} else if departmentPKsQuery != nil {
-		for _, dptPK := range departmentPKsQuery {
-			dptPK, err := strconv.Atoi(dptPK)
-			if err != nil {
-				log.Print(err)
-			}
-			dpt, err := models.SelectDepartmentWherePK(dptPK)
-			if err != nil {
-				log.Print(err)
-			}
-			departments = append(departments, dpt)
-			places, err = models.SelectPlacesWhereDepartmentPK(dptPK)
-			if err != nil {
-				log.Print(err)
-			}
-			newAnn, err := models.SelectAnnouncesWhereDepartmentPK(dptPK)
-			if err != nil {
-				log.Print(err)
-			}
-			ann = append(ann, newAnn...)
+		dpts[place.DepartmentPK] = dpt
+	}
+	return announceView{ann, place, dpt, loc}
+}
+
+// announceFilter reads the placePK, departmentPK, search, keyword, price,
+// rentcap, from, to, sort and cursor parameters of r. Dates are days of loc.
+func announceFilter(r *http.Request, loc *time.Location) (models.AnnounceFilter, error) {
+	q := r.URL.Query()
+	var f models.AnnounceFilter
+	var err error
+	f.PlacePKs, err = parseInts(q["placePK"])
+	if err != nil {
+		return f, err
+	}
+	f.DepartmentPKs, err = parseInts(q["departmentPK"])
+	if err != nil {
+		return f, err
+	}
+	f.Search = strings.TrimSpace(q.Get("search"))
+	for _, k := range q["keyword"] {
+		if k = strings.TrimSpace(k); k != "" {
+			f.Keywords = append(f.Keywords, k)
 		}
-		if places[0].City != "" {
-			sort.Sort(models.ByCity(places))
-		} else {
-			sort.Sort(models.ByArrondissement(places))
+	}
+	f.AboveRentCap = q.Get("rentcap") == "above"
+	for _, v := range q["price"] {
+		pr, err := parsePriceRange(v)
+		if err != nil {
+			return f, err
 		}
-	} else {
-		printDpts = true
-		var err error
-		ann, err = models.SelectAnnounces()
+		f.PriceRanges = append(f.PriceRanges, pr)
+	}
+	if v := q.Get("from"); v != "" {
+		f.DateFrom, err = parseDate(v, loc, false)
 		if err != nil {
-			log.Print(err)
+			return f, fmt.Errorf("invalid from %q", v)
 		}
-		departments, err = models.SelectDepartments()
+	}
+	if v := q.Get("to"); v != "" {
+		f.DateTo, err = parseDate(v, loc, true)
 		if err != nil {
-			log.Print(err)
+			return f, fmt.Errorf("invalid to %q", v)
 		}
-		sort.Sort(models.ByName(departments))
-		places, err = models.SelectPlaces()
+	}
+	f.Sort = q.Get("sort")
+	if !models.ValidSort(f.Sort) {
+		return f, fmt.Errorf("invalid sort %q", f.Sort)
+	}
+	if v := q.Get("cursor"); v != "" {
+		f.After, err = decodeCursor(v)
 		if err != nil {
-			log.Print(err)
+			return f, fmt.Errorf("invalid cursor %q", v)
 		}
 	}
+	return f, nil
+}
 
-	for _, d := range departments {
-		dptMap[d.PK] = d
+// parseDate parses an RFC 3339 time or a date in loc. If end is true, a
+// date means the end of the day.
+func parseDate(s string, loc *time.Location, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
 	}
-	for _, p := range places {
-		placesMap[p.PK] = p
+	t, err = time.ParseInLocation("2006-01-02", s, loc)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
 	}
+	return t, err
+}
 
-	data := struct {
-		Departments []models.Department
-		Places      []models.Place
-		Announces   []models.Announce
-		DptMap      map[int]models.Department
-		PlaceMap    map[int]models.Place
-		Location    *time.Location
-		PrintDpts   bool
-	}{departments, places, ann, dptMap, placesMap, paris, printDpts}
-	t := template.Must(template.ParseFiles("template.html"))
-	err := t.Execute(w, data)
+// encodeCursor returns an opaque representation of c.
+func encodeCursor(c *models.Cursor) string {
+	s := fmt.Sprintf("%d:%d:%d", c.Time.UnixNano(), c.Price, c.PK)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(s string) (*models.Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		log.Print(err)
+		return nil, err
 	}
+	var nsec int64
+	var c models.Cursor
+	_, err = fmt.Sscanf(string(b), "%d:%d:%d", &nsec, &c.Price, &c.PK)
+	if err != nil {
+		return nil, err
+	}
+	c.Time = time.Unix(0, nsec)
+	return &c, nil
 }
 
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("$PORT must be set")
+// serve runs the roles of the configuration until SIGINT or SIGTERM.
+// Processes without the web role serve /metrics, /healthz and /readyz only,
+// when the port is set.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("pollbc serve", flag.ExitOnError)
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkArgs(fs, 0, "pollbc serve")
+	if err != nil {
+		return err
+	}
+	a := &app{cfg: cfg}
+	roles := cfg.Roles
+	var required []string
+	if roles.Has(config.RoleWeb) {
+		required = append(required, "port")
+	}
+	// Sessions and the links sent by email are signed.
+	if roles.Has(config.RoleWeb) || roles.Has(config.RoleNotifier) {
+		required = append(required, "secret_key")
+	}
+	err = cfg.Require(required...)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	err = openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	if roles.Has(config.RoleWeb) || roles.Has(config.RoleNotifier) {
+		err = a.setupMail()
+		if err != nil {
+			return fmt.Errorf("invalid mail configuration: %w", err)
+		}
 	}
-	log.Printf("Listening on port %v", port)
+	if roles.Has(config.RolePoller) {
+		err = setupRentControl(cfg.RentControlFile)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("starting", "roles", roles.String())
 
-	go poll()
-	go deleteOldAnnounces()
+	ctx, stop := signalContext()
+	defer stop()
 
-	http.Handle("/css/", http.FileServer(http.Dir("static")))
-	http.Handle("/js/", http.FileServer(http.Dir("static")))
-	http.HandleFunc("/", serveHTTP)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	var workers sync.WaitGroup
+	for _, w := range []struct {
+		role string
+		run  func(context.Context)
+	}{
+		{config.RolePoller, a.poll},
+		{config.RoleNotifier, a.deliverOutbox},
+		{config.RoleJanitor, a.deleteOldAnnounces},
+	} {
+		if !roles.Has(w.role) {
+			continue
+		}
+		workers.Add(1)
+		go func(run func(context.Context)) {
+			defer workers.Done()
+			run(ctx)
+		}(w.run)
+	}
+
+	http.Handle("/metrics", metricsHandler(cfg.MetricsToken))
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", a.serveReadyz)
+	if roles.Has(config.RoleWeb) {
+		pks, err := models.ListenAnnounces(ctx)
+		if err != nil {
+			return fmt.Errorf("listening to new announces: %w", err)
+		}
+		go announcesHub.run(pks)
+
+		http.Handle("/css/", http.FileServer(http.Dir("static")))
+		http.Handle("/js/", http.FileServer(http.Dir("static")))
+		http.HandleFunc("/signup", a.serveSignup)
+		http.HandleFunc("/confirm", a.serveConfirm)
+		http.HandleFunc("/unsubscribe", a.serveUnsubscribe)
+		http.HandleFunc("/login", a.serveLogin)
+		http.HandleFunc("/login/confirm", a.serveLoginConfirm)
+		http.HandleFunc("/logout", serveLogout)
+		http.HandleFunc("/account", a.serveAccount)
+		http.HandleFunc("/feed/", a.serveFeed)
+		http.HandleFunc("/stream", a.serveStream)
+		http.HandleFunc("/stats", a.serveStats)
+		a.handleAPI(http.DefaultServeMux)
+		http.HandleFunc("/", a.serveHTTP)
+	}
+
+	var srv *http.Server
+	if cfg.Port != "" {
+		srv = &http.Server{Addr: ":" + cfg.Port, Handler: a.withUser(instrumentHTTP(http.DefaultServeMux))}
+		go func() {
+			slog.Info("listening", "port", cfg.Port)
+			err := srv.ListenAndServe()
+			if err != http.ErrServerClosed {
+				fatal("serving HTTP", "err", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if srv != nil {
+		err = srv.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("shutting down HTTP server", "err", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		slog.Warn("workers still running after the shutdown timeout")
+	}
+	err = models.Close()
+	if err != nil {
+		slog.Error("closing database", "err", err)
+	}
+	return nil
 }
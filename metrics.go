@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yansal/pollbc/metrics"
+)
+
+var (
+	fetchDuration = metrics.NewHistogram("pollbc_fetch_duration_seconds",
+		"Duration of the fetches of the pages of announces, by source and status.",
+		metrics.DefaultBuckets, "source", "status")
+	nodesParsed = metrics.NewCounter("pollbc_nodes_parsed_total",
+		"Number of announce nodes found in the fetched pages.")
+	parseErrors = metrics.NewCounter("pollbc_parse_errors_total",
+		"Number of errors parsing announce nodes, by field.", "field")
+	announcesInserted = metrics.NewCounter("pollbc_announces_inserted_total",
+		"Number of new announces inserted.")
+	notificationsSent = metrics.NewCounter("pollbc_notifications_sent_total",
+		"Number of announces notified, by channel.", "channel")
+	notificationsFailed = metrics.NewCounter("pollbc_notifications_failed_total",
+		"Number of announces whose notification attempt failed, by channel.", "channel")
+	announcesDeleted = metrics.NewCounter("pollbc_announces_deleted_total",
+		"Number of announces deleted by the retention job.")
+	httpDuration = metrics.NewHistogram("pollbc_http_request_duration_seconds",
+		"Latency of HTTP requests, by handler pattern, method and status code.",
+		metrics.DefaultBuckets, "handler", "method", "code")
+)
+
+// instrumentHTTP records the latency of the requests served by mux.
+func instrumentHTTP(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r)
+		method := r.Method
+		switch method {
+		case "GET", "HEAD", "POST":
+		default:
+			method = "other"
+		}
+		// The mux sets the pattern of r, which bounds the number of
+		// series.
+		handler := r.Pattern
+		if handler == "" {
+			handler = "none"
+		}
+		httpDuration.Observe(time.Since(start).Seconds(), handler, method, strconv.Itoa(sw.status))
+	})
+}
+
+// metricsHandler serves the metrics, to the requests that carry token
+// when it is set.
+func metricsHandler(token string) http.Handler {
+	if token == "" {
+		return metrics.Handler()
+	}
+	return requireBearer(token, metrics.Handler())
+}
+
+// requireBearer serves the requests to h that carry token in their
+// Authorization header, and responds 401 to the others.
+func requireBearer(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets serveStream flush through w.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
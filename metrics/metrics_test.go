@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	defer func(r *Registry) { Default = r }(Default)
+	Default = new(Registry)
+
+	NewCounter("test_empty_total", "A counter without labels.")
+	c := NewCounter("test_requests_total", "Requests,\nby \"code\" and path\\.", "code", "path")
+	c.Inc("200", "/")
+	c.Add(2.5, "200", "/")
+	c.Inc("500", `/a"b\c`+"\n")
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, "handler")
+	h.Observe(0.05, "x")
+	h.Observe(0.1, "x")
+	h.Observe(0.5, "x")
+	h.Observe(2, "x")
+	h.Observe(math.Inf(1), "y")
+
+	buf := new(bytes.Buffer)
+	err := Default.WriteText(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_empty_total A counter without labels.
+# TYPE test_empty_total counter
+test_empty_total 0
+# HELP test_requests_total Requests,\nby "code" and path\\.
+# TYPE test_requests_total counter
+test_requests_total{code="200",path="/"} 3.5
+test_requests_total{code="500",path="/a\"b\\c\n"} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="x",le="0.1"} 2
+test_duration_seconds_bucket{handler="x",le="1"} 3
+test_duration_seconds_bucket{handler="x",le="+Inf"} 4
+test_duration_seconds_sum{handler="x"} 2.65
+test_duration_seconds_count{handler="x"} 4
+test_duration_seconds_bucket{handler="y",le="0.1"} 0
+test_duration_seconds_bucket{handler="y",le="1"} 0
+test_duration_seconds_bucket{handler="y",le="+Inf"} 1
+test_duration_seconds_sum{handler="y"} +Inf
+test_duration_seconds_count{handler="y"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer func(r *Registry) { Default = r }(Default)
+	Default = new(Registry)
+	NewCounter("test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	if want := "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n"; rec.Body.String() != want {
+		t.Errorf("got %q, want %q", rec.Body, want)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	defer func(r *Registry) { Default = r }(Default)
+	Default = new(Registry)
+	c := NewCounter("test_total", "Test.", "code")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with a missing label value")
+		}
+	}()
+	c.Inc()
+}
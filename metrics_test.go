@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireBearer(t *testing.T) {
+	h := requireBearer("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"Bearer s3cre", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("Authorization %q: got %d, want %d", tt.authorization, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	for _, tt := range []struct {
+		token, authorization string
+		status               int
+	}{
+		{"", "", http.StatusOK},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "Bearer s3cret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		metricsHandler(tt.token).ServeHTTP(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("token %q, Authorization %q: got %d, want %d", tt.token, tt.authorization, rec.Code, tt.status)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"math"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type Announce struct {
@@ -15,6 +20,60 @@ type Announce struct {
 	Fetched time.Time
 
 	PlacePK int
+
+	// PriceValue is Price in euros, or 0 if unknown.
+	PriceValue int
+
+	// MarketPrice is the median price around ann when it was inserted, or
+	// 0 if unknown. BelowMarket is true if PriceValue was low enough
+	// compared to MarketPrice.
+	MarketPrice int
+	BelowMarket bool
+
+	// Surface is in square meters, the share of one tenant for
+	// colocations, and RentCap is the maximum legal rent for it, charges
+	// excluded, in euros. Rent is the price without the charges, when the
+	// title tells them. They are 0 if unknown.
+	Surface int
+	RentCap int
+	Rent    int
+}
+
+// RentExcess returns how much the rent of ann, charges excluded, exceeds
+// its rent cap, in euros, or 0.
+func (ann Announce) RentExcess() int {
+	if ann.Rent == 0 || ann.RentCap == 0 || ann.Rent <= ann.RentCap {
+		return 0
+	}
+	return ann.Rent - ann.RentCap
+}
+
+// Discount returns how much cheaper ann is than the market, in percent.
+func (ann Announce) Discount() int {
+	if ann.PriceValue == 0 || ann.MarketPrice == 0 {
+		return 0
+	}
+	return 100 - 100*ann.PriceValue/ann.MarketPrice
+}
+
+// ParsePrice returns the amount of a price as displayed by leboncoin.fr,
+// such as "1 200 €", or 0 if there is none.
+func ParsePrice(price string) int {
+	var digits []rune
+	for _, r := range price {
+		if unicode.IsDigit(r) {
+			digits = append(digits, r)
+		}
+	}
+	v, _ := strconv.Atoi(string(digits))
+	return v
+}
+
+const announceColumns = "a.pk, a.url, a.date, a.price, a.title, a.fetched, a.place_pk, COALESCE(a.price_value, 0), COALESCE(a.market_price, 0), a.below_market, COALESCE(a.surface, 0), COALESCE(a.rent_cap, 0), COALESCE(a.rent, 0)"
+
+// dest returns the destinations to scan announceColumns into.
+func (a *Announce) dest() []interface{} {
+	return []interface{}{&a.PK, &a.URL, &a.Date, &a.Price, &a.Title, &a.Fetched, &a.PlacePK, &a.PriceValue, &a.MarketPrice, &a.BelowMarket, &a.Surface, &a.RentCap, &a.Rent}
 }
 
 func CreateTableAnnounces() error {
@@ -27,12 +86,28 @@ func CreateTableAnnounces() error {
 		fetched timestamp with time zone NOT NULL,
 		place_pk serial REFERENCES pollbc_places(pk)
 	);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE pollbc_announces
+		ADD COLUMN IF NOT EXISTS price_value integer,
+		ADD COLUMN IF NOT EXISTS market_price integer,
+		ADD COLUMN IF NOT EXISTS below_market boolean NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS surface integer,
+		ADD COLUMN IF NOT EXISTS rent_cap integer,
+		ADD COLUMN IF NOT EXISTS rent integer;`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE pollbc_announces
+		SET price_value = NULLIF(regexp_replace(price, '[^0-9]', '', 'g'), '')::integer
+		WHERE price_value IS NULL AND price ~ '[0-9]'`)
 	return err
 }
 
-func HasAnnounce(url string) (bool, error) {
+func HasAnnounce(ctx context.Context, url string) (bool, error) {
 	var pk int
-	err := db.QueryRow("SELECT pk FROM pollbc_announces WHERE url=$1", url).Scan(&pk)
+	err := db.QueryRowContext(ctx, "SELECT pk FROM pollbc_announces WHERE url=$1", url).Scan(&pk)
 	if err == sql.ErrNoRows {
 		return false, nil
 	} else if err != nil {
@@ -42,23 +117,104 @@ func HasAnnounce(url string) (bool, error) {
 	}
 }
 
-func InsertAnnounce(ann Announce) error {
-	_, err := db.Exec("INSERT INTO pollbc_announces (url, date, price, title, fetched, place_pk) VALUES ($1, $2, $3, $4, $5, $6)",
-		ann.URL, ann.Date, ann.Price, ann.Title, ann.Fetched, ann.PlacePK)
-	return err
-}
+// InsertAnnounce scores ann against the market, inserts it and returns its
+// pk. In the same transaction, it queues the notification of ann to every
+// channel of the active users subscribed to its place, department or
+// region, and who want it. The announce is rolled up in the days of the time
+// zone loc.
+func InsertAnnounce(ctx context.Context, ann Announce, loc *time.Location) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-func SelectAnnounces() ([]Announce, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_announces ORDER BY date DESC LIMIT 35")
+	if ann.PriceValue != 0 {
+		ann.MarketPrice, err = marketPrice(ctx, tx, ann, loc)
+		if err != nil {
+			return 0, err
+		}
+		ann.BelowMarket = ann.MarketPrice != 0 && float64(ann.PriceValue) <= BelowMarketRatio*float64(ann.MarketPrice)
+	}
+
+	var pk int
+	err = tx.QueryRowContext(ctx, "INSERT INTO pollbc_announces (url, date, price, title, fetched, place_pk, price_value, market_price, below_market, surface, rent_cap, rent) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), NULLIF($8, 0), $9, NULLIF($10, 0), NULLIF($11, 0), NULLIF($12, 0)) RETURNING pk",
+		ann.URL, ann.Date, ann.Price, ann.Title, ann.Fetched, ann.PlacePK, ann.PriceValue, ann.MarketPrice, ann.BelowMarket, ann.Surface, ann.RentCap, ann.Rent).Scan(&pk)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer rows.Close()
-	return scanAnnounces(rows)
+
+	rows, err := tx.QueryContext(ctx, `SELECT `+prefixColumns("u.", userColumns)+`, c.pk FROM pollbc_users u
+		JOIN pollbc_channels c ON c.user_pk = u.pk
+		WHERE u.active AND (NOT u.deals_only OR $2) AND `+subscribedTo("$1"), ann.PlacePK, ann.BelowMarket)
+	if err != nil {
+		return 0, err
+	}
+	type subscriber struct {
+		user      User
+		channelPK int
+	}
+	var subscribers []subscriber
+	for rows.Next() {
+		var s subscriber
+		err := rows.Scan(append(s.user.dest(), &s.channelPK)...)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		subscribers = append(subscribers, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, s := range subscribers {
+		_, err = tx.ExecContext(ctx, "INSERT INTO pollbc_outbox (user_pk, announce_pk, channel_pk, deliver_after) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			s.user.PK, pk, s.channelPK, s.user.NextDelivery(now))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = rollupAnnounce(ctx, tx, ann, loc)
+	if err != nil {
+		return 0, err
+	}
+
+	// Listeners are notified when the transaction commits.
+	_, err = tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", announcesChannel, strconv.Itoa(pk))
+	if err != nil {
+		return 0, err
+	}
+	return pk, tx.Commit()
+}
+
+// SelectAnnounceWherePK returns sql.ErrNoRows if there is no such announce.
+func SelectAnnounceWherePK(ctx context.Context, pk int) (ann Announce, err error) {
+	err = db.QueryRowContext(ctx, "SELECT "+announceColumns+" FROM pollbc_announces a WHERE a.pk=$1",
+		pk).Scan(ann.dest()...)
+	return ann, err
+}
+
+// SelectLastAnnouncePK returns the pk of the last inserted announce, or 0.
+func SelectLastAnnouncePK(ctx context.Context) (pk int, err error) {
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(max(pk), 0) FROM pollbc_announces").Scan(&pk)
+	return pk, err
 }
 
-func SelectAnnouncesWherePlacePK(placePK int) ([]Announce, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_announces WHERE place_pk=$1 ORDER BY date DESC LIMIT 35", placePK)
+// SelectAnnouncesWherePKs returns announces ordered by place and date.
+func SelectAnnouncesWherePKs(ctx context.Context, pks []int) ([]Announce, error) {
+	if len(pks) == 0 {
+		return nil, nil
+	}
+	in, args := intsIn(pks, 1)
+	rows, err := db.QueryContext(ctx, `SELECT `+announceColumns+` FROM pollbc_announces a
+		JOIN pollbc_places pl ON pl.pk = a.place_pk
+		JOIN pollbc_departements d ON d.pk = pl.department_pk
+		WHERE a.pk IN `+in+`
+		ORDER BY d.name, pl.city, pl.arrondissement, a.place_pk, a.date DESC`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -66,8 +222,226 @@ func SelectAnnouncesWherePlacePK(placePK int) ([]Announce, error) {
 	return scanAnnounces(rows)
 }
 
-func SelectAnnouncesWhereDepartmentPK(departmendPK int) ([]Announce, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_announces WHERE place_pk IN (SELECT pk from pollbc_places WHERE department_pk=$1) ORDER BY date DESC LIMIT 35", departmendPK)
+// An AnnounceFilter selects announces. Announces match if they are in one
+// of PlacePKs, or in one of DepartmentPKs where none of PlacePKs is, their
+// title contains Search and every one of Keywords, their price is between
+// PriceMin and PriceMax and in one of PriceRanges, and they were posted
+// between DateFrom (included) and DateTo (excluded). Zero fields don't
+// filter.
+//
+// Announces are ordered by Sort, which defaults to SortDate.
+type AnnounceFilter struct {
+	PlacePKs      []int
+	DepartmentPKs []int
+	Search        string
+	Keywords      []string
+	PriceMin      int
+	PriceMax      int
+	PriceRanges   []PriceRange
+	DateFrom      time.Time
+	DateTo        time.Time
+	Sort          string
+
+	// AboveRentCap selects the announces whose rent exceeds their
+	// rent cap.
+	AboveRentCap bool
+	// After, if not nil, selects the announces that come after it in the
+	// results, for keyset pagination.
+	After *Cursor
+	// SincePK, if not 0, selects the announces inserted after the one whose
+	// pk it is.
+	SincePK int
+	// Limit defaults to 35.
+	Limit int
+}
+
+// Orders of announces. Announces without a price come last when sorted by
+// price.
+const (
+	SortDate      = "date"
+	SortFetched   = "fetched"
+	SortPrice     = "price"
+	SortPriceDesc = "-price"
+
+	// SortInserted orders announces by pk, which is the order they were
+	// inserted in, oldest first. It is not a valid sort of the web UI
+	// and can't be paginated with After.
+	SortInserted = "inserted"
+)
+
+// ValidSort reports whether sort is one of the orders of announces.
+func ValidSort(sort string) bool {
+	switch sort {
+	case "", SortDate, SortFetched, SortPrice, SortPriceDesc:
+		return true
+	}
+	return false
+}
+
+// sortKey returns the expression announces are ordered by, before their pk.
+func (f AnnounceFilter) sortKey() (key string, desc bool) {
+	switch f.Sort {
+	case SortFetched:
+		return "a.fetched", true
+	case SortPrice:
+		return "COALESCE(a.price_value, 2147483647)", false
+	case SortPriceDesc:
+		return "COALESCE(a.price_value, -1)", true
+	case SortInserted:
+		return "a.pk", false
+	}
+	return "a.date", true
+}
+
+// A Cursor is the position of an announce in ordered results. Time is set
+// when they are ordered by date or fetch time, and Price when they are
+// ordered by price.
+type Cursor struct {
+	Time  time.Time
+	Price int
+	PK    int
+}
+
+// CursorOf returns the position of ann in the results of f.
+func (f AnnounceFilter) CursorOf(ann Announce) *Cursor {
+	c := &Cursor{PK: ann.PK}
+	switch f.Sort {
+	case SortFetched:
+		c.Time = ann.Fetched
+	case SortPrice:
+		c.Price = ann.PriceValue
+		if c.Price == 0 {
+			c.Price = math.MaxInt32
+		}
+	case SortPriceDesc:
+		c.Price = ann.PriceValue
+		if c.Price == 0 {
+			c.Price = -1
+		}
+	default:
+		c.Time = ann.Date
+	}
+	return c
+}
+
+// where returns the WHERE clause of f, for announces aliased as a, and its
+// arguments.
+func (f AnnounceFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if cond, placeArgs := placesCond("a.place_pk", f.PlacePKs, f.DepartmentPKs, len(args)+1); cond != "" {
+		conds = append(conds, cond)
+		args = append(args, placeArgs...)
+	}
+	if f.Search != "" {
+		args = append(args, "%"+likeEscaper.Replace(f.Search)+"%")
+		conds = append(conds, "a.title ILIKE $"+strconv.Itoa(len(args)))
+	}
+	for _, k := range f.Keywords {
+		args = append(args, "%"+likeEscaper.Replace(k)+"%")
+		conds = append(conds, "a.title ILIKE $"+strconv.Itoa(len(args)))
+	}
+	if len(f.PriceRanges) > 0 {
+		var ranges []string
+		for _, r := range f.PriceRanges {
+			var cond string
+			cond, args = r.cond(args)
+			ranges = append(ranges, cond)
+		}
+		conds = append(conds, "("+strings.Join(ranges, " OR ")+")")
+	}
+	if f.PriceMin != 0 {
+		args = append(args, f.PriceMin)
+		conds = append(conds, "a.price_value >= $"+strconv.Itoa(len(args)))
+	}
+	if f.PriceMax != 0 {
+		args = append(args, f.PriceMax)
+		conds = append(conds, "a.price_value <= $"+strconv.Itoa(len(args)))
+	}
+	if f.AboveRentCap {
+		conds = append(conds, "a.rent > a.rent_cap")
+	}
+	if !f.DateFrom.IsZero() {
+		args = append(args, f.DateFrom)
+		conds = append(conds, "a.date >= $"+strconv.Itoa(len(args)))
+	}
+	if !f.DateTo.IsZero() {
+		args = append(args, f.DateTo)
+		conds = append(conds, "a.date < $"+strconv.Itoa(len(args)))
+	}
+	if f.After != nil {
+		key, desc := f.sortKey()
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		if f.Sort == SortPrice || f.Sort == SortPriceDesc {
+			args = append(args, f.After.Price)
+		} else {
+			args = append(args, f.After.Time)
+		}
+		args = append(args, f.After.PK)
+		conds = append(conds, "("+key+", a.pk) "+op+" ($"+strconv.Itoa(len(args)-1)+", $"+strconv.Itoa(len(args))+")")
+	}
+	if f.SincePK != 0 {
+		args = append(args, f.SincePK)
+		conds = append(conds, "a.pk > $"+strconv.Itoa(len(args)))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// placesCond returns the condition that column, a place pk, is in one of
+// placePKs, or in one of dptPKs where none of placePKs is, and its
+// arguments, numbered from first. It returns "" if both are empty.
+func placesCond(column string, placePKs, dptPKs []int, first int) (string, []interface{}) {
+	var places []string
+	var args []interface{}
+	var placesIn string
+	if len(placePKs) > 0 {
+		var inArgs []interface{}
+		placesIn, inArgs = intsIn(placePKs, first)
+		places = append(places, column+" IN "+placesIn)
+		args = append(args, inArgs...)
+	}
+	if len(dptPKs) > 0 {
+		in, inArgs := intsIn(dptPKs, first+len(args))
+		cond := column + " IN (SELECT pk FROM pollbc_places WHERE department_pk IN " + in
+		if placesIn != "" {
+			// Places narrow down their department.
+			cond += " AND department_pk NOT IN (SELECT department_pk FROM pollbc_places WHERE pk IN " + placesIn + ")"
+		}
+		places = append(places, cond+")")
+		args = append(args, inArgs...)
+	}
+	if len(places) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(places, " OR ") + ")", args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SelectAnnouncesFilter returns the first announces matching f.
+func SelectAnnouncesFilter(ctx context.Context, f AnnounceFilter) ([]Announce, error) {
+	where, args := f.where()
+	limit := f.Limit
+	if limit == 0 {
+		limit = 35
+	}
+	args = append(args, limit)
+	key, desc := f.sortKey()
+	dir := " ASC"
+	if desc {
+		dir = " DESC"
+	}
+	order := key + dir
+	if key != "a.pk" {
+		order += ", a.pk" + dir
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+announceColumns+" FROM pollbc_announces a"+where+" ORDER BY "+order+" LIMIT $"+strconv.Itoa(len(args)), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +453,7 @@ func scanAnnounces(rows *sql.Rows) ([]Announce, error) {
 	ann := make([]Announce, 0)
 	for rows.Next() {
 		a := Announce{}
-		err := rows.Scan(&a.PK, &a.URL, &a.Date, &a.Price, &a.Title, &a.Fetched, &a.PlacePK)
+		err := rows.Scan(a.dest()...)
 		if err != nil {
 			return ann, err
 		}
@@ -92,8 +466,10 @@ func scanAnnounces(rows *sql.Rows) ([]Announce, error) {
 	return ann, nil
 }
 
-func DeleteAnnounces() (int64, error) {
-	res, err := db.Exec("DELETE FROM pollbc_announces WHERE date < NOW() - interval '1 month'")
+// DeleteAnnounces deletes the announces posted more than retention ago.
+func DeleteAnnounces(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM pollbc_announces WHERE date < now() - $1 * interval '1 second'",
+		int64(retention/time.Second))
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,77 @@
+package models
+
+import "context"
+
+// Kinds of notification channels.
+const (
+	ChannelEmail    = "email"
+	ChannelWebhook  = "webhook"
+	ChannelSlack    = "slack"
+	ChannelTelegram = "telegram"
+)
+
+// A Channel is a way to notify a user. Target is an email address, a URL or
+// a Telegram chat id depending on Kind.
+type Channel struct {
+	PK     int
+	UserPK int
+	Kind   string
+	Target string
+}
+
+func CreateTableChannels() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_channels (
+		pk serial PRIMARY KEY,
+		user_pk integer NOT NULL REFERENCES pollbc_users(pk) ON DELETE CASCADE,
+		kind text NOT NULL,
+		target text NOT NULL,
+		UNIQUE(user_pk, kind, target)
+	);`)
+	if err != nil {
+		return err
+	}
+	// Users created before channels existed are notified by email.
+	_, err = db.Exec(`INSERT INTO pollbc_channels (user_pk, kind, target)
+		SELECT pk, 'email', email FROM pollbc_users u
+		WHERE NOT EXISTS (SELECT 1 FROM pollbc_channels c WHERE c.user_pk = u.pk)`)
+	return err
+}
+
+func InsertChannel(ctx context.Context, ch Channel) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_channels (user_pk, kind, target) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		ch.UserPK, ch.Kind, ch.Target)
+	return err
+}
+
+func DeleteChannel(ctx context.Context, userPK, pk int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM pollbc_channels WHERE user_pk=$1 AND pk=$2", userPK, pk)
+	return err
+}
+
+func SelectChannelWherePK(ctx context.Context, pk int) (ch Channel, err error) {
+	err = db.QueryRowContext(ctx, "SELECT pk, user_pk, kind, target FROM pollbc_channels WHERE pk=$1",
+		pk).Scan(&ch.PK, &ch.UserPK, &ch.Kind, &ch.Target)
+	return ch, err
+}
+
+func SelectChannelsWhereUserPK(ctx context.Context, userPK int) ([]Channel, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pk, user_pk, kind, target FROM pollbc_channels WHERE user_pk=$1 ORDER BY pk", userPK)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var channels []Channel
+	for rows.Next() {
+		var ch Channel
+		err := rows.Scan(&ch.PK, &ch.UserPK, &ch.Kind, &ch.Target)
+		if err != nil {
+			return channels, err
+		}
+
+		channels = append(channels, ch)
+	}
+	if err := rows.Err(); err != nil {
+		return channels, err
+	}
+	return channels, nil
+}
@@ -1,42 +1,79 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
 	_ "github.com/yansal/pollbc/Godeps/_workspace/src/github.com/lib/pq"
 )
 
 var db *sql.DB
 
-func InitDB(datasourceName string) {
+// dataSourceName is kept for the connections that database/sql doesn't
+// manage.
+var dataSourceName string
+
+// Open connects to the database.
+func Open(datasourceName string) error {
+	dataSourceName = datasourceName
 	var err error
 	db, err = sql.Open("postgres", datasourceName)
 	if err != nil {
-		panic(err)
-	}
-	err = db.Ping()
-	if err != nil {
-		panic(err)
+		return err
 	}
+	return db.Ping()
+}
 
-	err = CreateTableDepartements()
-	if err != nil {
-		panic(err)
-	}
-	err = CreateTablePlaces()
-	if err != nil {
-		panic(err)
-	}
-	err = CreateTableAnnounces()
+// OpenDB makes the models use d, which tests open with a fake driver.
+func OpenDB(d *sql.DB) {
+	db = d
+}
+
+// migrateLock is the key of the advisory lock held while migrating.
+const migrateLock = 7140519
+
+// Migrate creates the tables and the columns that are missing, and rolls up
+// the existing announces in the days of the time zone loc. Processes
+// starting together migrate one after the other.
+func Migrate(loc *time.Location) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = CreateTableUsers()
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrateLock)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = CreateTableUsersPlaces()
-	if err != nil {
-		panic(err)
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrateLock)
+
+	for _, create := range []func() error{
+		CreateTableRegions,
+		CreateTableDepartements,
+		CreateTablePlaces,
+		CreateTableAnnounces,
+		func() error { return CreateTableStats(loc) },
+		CreateTableUsers,
+		CreateTableUsersPlaces,
+		CreateTableUsersDepartments,
+		CreateTableUsersRegions,
+		CreateTableSignups,
+		CreateTableChannels,
+		CreateTableOutbox,
+		CreateTablePolls,
+		CreateTableSources,
+	} {
+		err := create()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// Close closes the database, waiting for the queries in progress.
+func Close() error {
+	return db.Close()
 }
@@ -1,10 +1,17 @@
 package models
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
 
 type Department struct {
 	PK   int
 	Name string
+
+	// RegionPK is 0 if the region of the department is unknown.
+	RegionPK int
 }
 
 type ByName []Department
@@ -18,12 +25,48 @@ func CreateTableDepartements() error {
 		pk serial PRIMARY KEY,
 		name text UNIQUE NOT NULL
 	);`)
-	return err
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE pollbc_departements
+		ADD COLUMN IF NOT EXISTS region_pk integer REFERENCES pollbc_regions(pk);`)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT name FROM pollbc_departements WHERE region_pk IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		region, ok := DepartmentRegion(name)
+		if !ok {
+			continue
+		}
+		_, err = db.Exec("UPDATE pollbc_departements SET region_pk=(SELECT pk FROM pollbc_regions WHERE name=$2) WHERE name=$1",
+			name, region)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func HasDepartment(dpt Department) (bool, error) {
+func HasDepartment(ctx context.Context, dpt Department) (bool, error) {
 	var pk int
-	err := db.QueryRow("SELECT pk FROM pollbc_departements WHERE name=$1",
+	err := db.QueryRowContext(ctx, "SELECT pk FROM pollbc_departements WHERE name=$1",
 		dpt.Name).Scan(&pk)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -34,14 +77,23 @@ func HasDepartment(dpt Department) (bool, error) {
 	}
 }
 
-func InsertDepartment(dpt Department) error {
-	_, err := db.Exec("INSERT INTO pollbc_departements (name) VALUES ($1)",
-		dpt.Name)
+// ErrUnknownRegion is returned by InsertDepartment for the departments
+// that are not in the table of the regions. They are inserted without a
+// region.
+var ErrUnknownRegion = errors.New("unknown region")
+
+func InsertDepartment(ctx context.Context, dpt Department) error {
+	region, ok := DepartmentRegion(dpt.Name)
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_departements (name, region_pk) VALUES ($1, (SELECT pk FROM pollbc_regions WHERE name=$2))",
+		dpt.Name, region)
+	if err == nil && !ok {
+		err = ErrUnknownRegion
+	}
 	return err
 }
 
-func SelectDepartments() ([]Department, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_departements")
+func SelectDepartments(ctx context.Context) ([]Department, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pk, name, COALESCE(region_pk, 0) FROM pollbc_departements")
 	if err != nil {
 		return nil, err
 	}
@@ -49,7 +101,7 @@ func SelectDepartments() ([]Department, error) {
 	var dpts []Department
 	for rows.Next() {
 		dpt := Department{}
-		err := rows.Scan(&dpt.PK, &dpt.Name)
+		err := rows.Scan(&dpt.PK, &dpt.Name, &dpt.RegionPK)
 		if err != nil {
 			return dpts, err
 		}
@@ -62,14 +114,46 @@ func SelectDepartments() ([]Department, error) {
 	return dpts, nil
 }
 
-func SelectDepartmentWherePK(pk int) (dpt Department, err error) {
-	err = db.QueryRow("SELECT * FROM pollbc_departements WHERE pk=$1",
-		pk).Scan(&dpt.PK, &dpt.Name)
+func SelectDepartmentWherePK(ctx context.Context, pk int) (dpt Department, err error) {
+	err = db.QueryRowContext(ctx, "SELECT pk, name, COALESCE(region_pk, 0) FROM pollbc_departements WHERE pk=$1",
+		pk).Scan(&dpt.PK, &dpt.Name, &dpt.RegionPK)
 	return
 }
 
-func SelectPKFromDepartment(dpt Department) (pk int, err error) {
-	err = db.QueryRow("SELECT pk FROM pollbc_departements WHERE name=$1",
+func SelectPKFromDepartment(ctx context.Context, dpt Department) (pk int, err error) {
+	err = db.QueryRowContext(ctx, "SELECT pk FROM pollbc_departements WHERE name=$1",
 		dpt.Name).Scan(&pk)
 	return pk, err
 }
+
+// A DepartmentCount is a department and its number of announces.
+type DepartmentCount struct {
+	Department
+	Announces int
+}
+
+func SelectDepartmentsCount(ctx context.Context) ([]DepartmentCount, error) {
+	rows, err := db.QueryContext(ctx, `SELECT d.pk, d.name, COALESCE(d.region_pk, 0), count(a.pk)
+		FROM pollbc_departements d
+		LEFT JOIN pollbc_places p ON p.department_pk = d.pk
+		LEFT JOIN pollbc_announces a ON a.place_pk = p.pk
+		GROUP BY d.pk ORDER BY d.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dpts []DepartmentCount
+	for rows.Next() {
+		var d DepartmentCount
+		err := rows.Scan(&d.PK, &d.Name, &d.RegionPK, &d.Announces)
+		if err != nil {
+			return dpts, err
+		}
+
+		dpts = append(dpts, d)
+	}
+	if err := rows.Err(); err != nil {
+		return dpts, err
+	}
+	return dpts, nil
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// A PriceRange is a range of prices from Min (included) to Max (excluded).
+// A Max of 0 means no upper bound.
+type PriceRange struct {
+	Min int
+	Max int
+}
+
+// cond returns the condition on a.price_value of r, with its arguments
+// appended to args.
+func (r PriceRange) cond(args []interface{}) (string, []interface{}) {
+	args = append(args, r.Min)
+	cond := "a.price_value >= $" + strconv.Itoa(len(args))
+	if r.Max != 0 {
+		args = append(args, r.Max)
+		cond = "(" + cond + " AND a.price_value < $" + strconv.Itoa(len(args)) + ")"
+	}
+	return cond, args
+}
+
+// PriceBuckets are the values of the price facet.
+var PriceBuckets = []PriceRange{{0, 400}, {400, 600}, {600, 800}, {800, 1000}, {1000, 0}}
+
+// Keywords are the suggested values of the keyword facet.
+var Keywords = []string{"meublé", "chambre", "studio", "balcon", "jardin", "parking", "étudiant"}
+
+// FacetCounts are the numbers of announces matching a filter for each value
+// of the facets. The count of a value of a facet ignores the selection in
+// that facet, except for keywords, which all apply.
+type FacetCounts struct {
+	Total       int
+	Places      map[int]int
+	Departments map[int]int
+	// Prices are indexed like PriceBuckets.
+	Prices   []int
+	Keywords map[string]int
+	// AboveRentCap is the number of announces whose rent is above their
+	// rent cap.
+	AboveRentCap int
+}
+
+// SelectFacetCounts counts the announces that match f for each place,
+// department and price bucket, and for each one of keywords.
+func SelectFacetCounts(ctx context.Context, f AnnounceFilter, keywords []string) (FacetCounts, error) {
+	f.After, f.Limit = nil, 0
+	counts := FacetCounts{
+		Places:      make(map[int]int),
+		Departments: make(map[int]int),
+		Keywords:    make(map[string]int),
+	}
+
+	g := f
+	g.PlacePKs, g.DepartmentPKs = nil, nil
+	where, args := g.where()
+	rows, err := db.QueryContext(ctx, `SELECT a.place_pk, pl.department_pk, count(*) FROM pollbc_announces a
+		JOIN pollbc_places pl ON pl.pk = a.place_pk`+where+`
+		GROUP BY a.place_pk, pl.department_pk`, args...)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var placePK, dptPK, count int
+		err := rows.Scan(&placePK, &dptPK, &count)
+		if err != nil {
+			return counts, err
+		}
+		counts.Places[placePK] = count
+		counts.Departments[dptPK] += count
+	}
+	if err := rows.Err(); err != nil {
+		return counts, err
+	}
+
+	g = f
+	g.PriceRanges = nil
+	where, args = g.where()
+	var selects []string
+	for _, r := range PriceBuckets {
+		var cond string
+		cond, args = r.cond(args)
+		selects = append(selects, "count(*) FILTER (WHERE "+cond+")")
+	}
+	counts.Prices = make([]int, len(PriceBuckets))
+	dest := make([]interface{}, len(PriceBuckets))
+	for i := range counts.Prices {
+		dest[i] = &counts.Prices[i]
+	}
+	err = db.QueryRowContext(ctx, "SELECT "+strings.Join(selects, ", ")+" FROM pollbc_announces a"+where, args...).Scan(dest...)
+	if err != nil {
+		return counts, err
+	}
+
+	where, args = f.where()
+	selects = []string{"count(*)", "count(*) FILTER (WHERE a.rent > a.rent_cap)"}
+	for _, k := range keywords {
+		args = append(args, "%"+likeEscaper.Replace(k)+"%")
+		selects = append(selects, "count(*) FILTER (WHERE a.title ILIKE $"+strconv.Itoa(len(args))+")")
+	}
+	keywordCounts := make([]int, len(keywords))
+	dest = []interface{}{&counts.Total, &counts.AboveRentCap}
+	for i := range keywordCounts {
+		dest = append(dest, &keywordCounts[i])
+	}
+	err = db.QueryRowContext(ctx, "SELECT "+strings.Join(selects, ", ")+" FROM pollbc_announces a"+where, args...).Scan(dest...)
+	if err != nil {
+		return counts, err
+	}
+	for i, k := range keywords {
+		counts.Keywords[k] = keywordCounts[i]
+	}
+	return counts, nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/yansal/pollbc/Godeps/_workspace/src/github.com/lib/pq"
+)
+
+// announcesChannel is notified with the pk of every inserted announce.
+const announcesChannel = "pollbc_announces"
+
+// ListenAnnounces returns a channel that receives the pk of every announce
+// inserted by any process. It receives 0 after the connection to the
+// database was lost, as announces may have been missed meanwhile. The
+// channel is closed when ctx is done.
+func ListenAnnounces(ctx context.Context) (<-chan int, error) {
+	l := pq.NewListener(dataSourceName, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Error("listening to announces", "err", err)
+		}
+	})
+	err := l.Listen(announcesChannel)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	c := make(chan int)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				l.Close()
+				close(c)
+				return
+			case n := <-l.Notify:
+				if n == nil {
+					// The listener reconnected.
+					c <- 0
+					continue
+				}
+				pk, err := strconv.Atoi(n.Extra)
+				if err != nil {
+					slog.Error("listening to announces", "err", err)
+					continue
+				}
+				c <- pk
+			case <-time.After(90 * time.Second):
+				// Check that the connection is alive.
+				go l.Ping()
+			}
+		}
+	}()
+	return c, nil
+}
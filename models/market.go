@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// BelowMarketRatio is the highest ratio of its price to the market price
+// for an announce to be below market.
+const BelowMarketRatio = 0.8
+
+const (
+	// marketDays is the number of days before an announce that the market
+	// price is computed over.
+	marketDays = 30
+	// marketMinPrices is the number of prices needed for a market price.
+	marketMinPrices = 10
+)
+
+// marketPrice returns the median price, to priceBucket euros, of the
+// announces posted in the place of ann in the marketDays before it, counted
+// in the time zone loc, or, if there were too few, in its department. It
+// returns 0 if there were too few in both.
+func marketPrice(ctx context.Context, tx *sql.Tx, ann Announce, loc *time.Location) (int, error) {
+	for _, cond := range []string{
+		"p.place_pk = $1",
+		"p.place_pk IN (SELECT pk FROM pollbc_places WHERE department_pk = (SELECT department_pk FROM pollbc_places WHERE pk = $1))",
+	} {
+		var median sql.NullFloat64
+		var count int
+		err := tx.QueryRowContext(ctx, `WITH b AS (SELECT p.bucket, sum(p.count) AS n
+				FROM pollbc_stats_prices p
+				WHERE `+cond+` AND p.day >= ($2::timestamptz AT TIME ZONE $4::text)::date - $3::integer
+				GROUP BY 1),
+			c AS (SELECT bucket, n, sum(n) OVER (ORDER BY bucket) - n AS below, sum(n) OVER () AS total FROM b)
+			SELECT `+quantile("0.5")+`, COALESCE(max(total), 0)::integer FROM c`,
+			ann.PlacePK, ann.Date, marketDays, loc.String()).Scan(&median, &count)
+		if err != nil {
+			return 0, err
+		}
+		if count >= marketMinPrices && median.Valid {
+			return int(median.Float64 + 0.5), nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An OutboxItem is the notification of an announce to a user through a
+// channel. Items are written in the same transaction as their announce and
+// delivered by a worker.
+type OutboxItem struct {
+	PK         int
+	UserPK     int
+	AnnouncePK int
+	ChannelPK  int
+	Attempts   int
+	// Claim identifies the ClaimOutbox that returned the item. The item
+	// is updated only while it still has this claim.
+	Claim int64
+}
+
+// ErrClaimLost is returned when updating items that were claimed again,
+// or given up, since they were returned by ClaimOutbox.
+var ErrClaimLost = errors.New("outbox claim lost")
+
+func CreateTableOutbox() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_outbox (
+		pk serial PRIMARY KEY,
+		user_pk integer NOT NULL REFERENCES pollbc_users(pk) ON DELETE CASCADE,
+		announce_pk integer NOT NULL REFERENCES pollbc_announces(pk) ON DELETE CASCADE,
+		channel_pk integer NOT NULL REFERENCES pollbc_channels(pk) ON DELETE CASCADE,
+		created timestamp with time zone NOT NULL DEFAULT now(),
+		deliver_after timestamp with time zone NOT NULL,
+		attempts integer NOT NULL DEFAULT 0,
+		claimed timestamp with time zone,
+		sent timestamp with time zone,
+		failed timestamp with time zone,
+		last_error text,
+		UNIQUE(user_pk, announce_pk, channel_pk)
+	);`)
+	if err != nil {
+		return err
+	}
+	// sending is set once the notifier is called, after which the items
+	// are never retried automatically.
+	_, err = db.Exec(`CREATE SEQUENCE IF NOT EXISTS pollbc_outbox_claims;
+		ALTER TABLE pollbc_outbox ADD COLUMN IF NOT EXISTS claim bigint,
+			ADD COLUMN IF NOT EXISTS sending timestamp with time zone`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS pollbc_outbox_due
+		ON pollbc_outbox (deliver_after) WHERE sent IS NULL AND failed IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	// The outbox replaces the pollbc_pending table of digests.
+	var hasPending bool
+	err = db.QueryRow("SELECT to_regclass('pollbc_pending') IS NOT NULL").Scan(&hasPending)
+	if err != nil || !hasPending {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO pollbc_outbox (user_pk, announce_pk, channel_pk, deliver_after)
+		SELECT p.user_pk, p.announce_pk, c.pk, now() FROM pollbc_pending p
+		JOIN pollbc_channels c ON c.user_pk = p.user_pk
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DROP TABLE pollbc_pending")
+	return err
+}
+
+// ClaimOutbox marks at most limit due items as being delivered and returns
+// them. Claimed items are not returned again until they are retried, so
+// several workers can deliver concurrently.
+func ClaimOutbox(ctx context.Context, limit int) ([]OutboxItem, error) {
+	rows, err := db.QueryContext(ctx, `WITH c AS (SELECT nextval('pollbc_outbox_claims') AS claim)
+		UPDATE pollbc_outbox SET claimed = now(), claim = c.claim, attempts = attempts + 1
+		FROM c
+		WHERE pk IN (
+			SELECT pk FROM pollbc_outbox
+			WHERE sent IS NULL AND failed IS NULL AND claimed IS NULL AND deliver_after <= now()
+			ORDER BY pk LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING pk, user_pk, announce_pk, channel_pk, attempts, pollbc_outbox.claim`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []OutboxItem
+	for rows.Next() {
+		var item OutboxItem
+		err := rows.Scan(&item.PK, &item.UserPK, &item.AnnouncePK, &item.ChannelPK, &item.Attempts, &item.Claim)
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return items, err
+	}
+	return items, nil
+}
+
+// RetryStaleClaims releases the items claimed for longer than lease, whose
+// worker died while delivering them. The items that were not being sent yet
+// are delivered again, unless they were already tried maxAttempts times.
+// The items that were being sent may have been sent already: they are given
+// up, so that they are never sent twice, and wait for someone to review
+// them. Their claim is cleared, so that their former worker can't update
+// them anymore.
+func RetryStaleClaims(ctx context.Context, lease time.Duration, maxAttempts int) (retried, failed int64, err error) {
+	rows, err := db.QueryContext(ctx, `UPDATE pollbc_outbox SET
+			claimed = NULL, claim = NULL, deliver_after = now(),
+			failed = CASE WHEN sending IS NOT NULL OR attempts >= $2 THEN now() END,
+			last_error = CASE WHEN sending IS NOT NULL THEN '`+ErrInterruptedSend.Error()+`'
+				ELSE 'interrupted before sending' END
+		WHERE sent IS NULL AND failed IS NULL AND claimed < now() - $1 * interval '1 second'
+		RETURNING failed IS NOT NULL`,
+		int64(lease/time.Second), maxAttempts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var gaveUp bool
+		err := rows.Scan(&gaveUp)
+		if err != nil {
+			return retried, failed, err
+		}
+		if gaveUp {
+			failed++
+		} else {
+			retried++
+		}
+	}
+	return retried, failed, rows.Err()
+}
+
+// ErrInterruptedSend is the last error of the items given up because their
+// sending was interrupted. They need a review: they may have been sent.
+var ErrInterruptedSend = errors.New("interrupted while sending, needs review")
+
+// MarkOutboxSending records that items are about to be sent. From then on,
+// they are never retried automatically.
+func MarkOutboxSending(ctx context.Context, items []OutboxItem) error {
+	return updateOutbox(ctx, items, "sending = now()", "sending IS NULL")
+}
+
+func MarkOutboxSent(ctx context.Context, items []OutboxItem) error {
+	return updateOutbox(ctx, items, "sent = now()", "")
+}
+
+// RetryOutbox releases items so that they are claimed again after delay.
+// It is for the items whose notifier reported that they were not sent.
+func RetryOutbox(ctx context.Context, items []OutboxItem, cause error, delay time.Duration) error {
+	return updateOutbox(ctx, items, "claimed = NULL, sending = NULL, deliver_after = now() + $1 * interval '1 second', last_error = $2", "",
+		int64(delay/time.Second), cause.Error())
+}
+
+// ReleaseOutbox returns claimed items to the queue without counting an
+// attempt, for instance when the worker stops before delivering them. The
+// items being sent are left claimed.
+func ReleaseOutbox(ctx context.Context, items []OutboxItem) error {
+	return updateOutbox(ctx, items, "claimed = NULL, attempts = attempts - 1", "sending IS NULL")
+}
+
+// MarkOutboxFailed gives up on items.
+func MarkOutboxFailed(ctx context.Context, items []OutboxItem, cause error) error {
+	return updateOutbox(ctx, items, "failed = now(), last_error = $1", "", cause.Error())
+}
+
+// updateOutbox updates items, which must come from the same ClaimOutbox,
+// unless they were claimed again or given up in the meantime. cond, if not
+// empty, is another condition on the items.
+func updateOutbox(ctx context.Context, items []OutboxItem, set, cond string, args ...interface{}) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var pks []int
+	for _, item := range items {
+		pks = append(pks, item.PK)
+	}
+	args = append(args, items[0].Claim)
+	in, inArgs := intsIn(pks, len(args)+1)
+	if cond != "" {
+		cond = " AND " + cond
+	}
+	res, err := db.ExecContext(ctx, "UPDATE pollbc_outbox SET "+set+
+		" WHERE claim = $"+strconv.Itoa(len(args))+" AND sent IS NULL AND failed IS NULL"+cond+" AND pk IN "+in,
+		append(args, inArgs...)...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n != int64(len(items)) {
+		err = ErrClaimLost
+	}
+	return err
+}
+
+// intsIn returns a list of placeholders starting at $first, and the
+// matching arguments, to query WHERE x IN the list of values.
+func intsIn(values []int, first int) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = "$" + strconv.Itoa(first+i)
+		args[i] = v
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// SelectOutboxBacklog returns the number of items due for delivery and the
+// creation time of the oldest one, which is zero when there is none.
+func SelectOutboxBacklog(ctx context.Context) (int, time.Time, error) {
+	var count int
+	var oldest sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT count(*), min(created) FROM pollbc_outbox
+		WHERE sent IS NULL AND failed IS NULL AND deliver_after <= now()`).Scan(&count, &oldest)
+	return count, oldest.Time, err
+}
+
+// ResendOutbox queues again the announces fetched from from to to that the
+// user is subscribed to and wants, to every channel of the user, and returns
+// the number of items queued. Items already sent or failed are delivered
+// again; items being delivered are left to their notifier.
+func ResendOutbox(ctx context.Context, userPK int, from, to time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, `INSERT INTO pollbc_outbox (user_pk, announce_pk, channel_pk, deliver_after)
+		SELECT u.pk, a.pk, c.pk, now() FROM pollbc_users u
+		JOIN pollbc_channels c ON c.user_pk = u.pk
+		JOIN pollbc_announces a ON a.fetched >= $2 AND a.fetched < $3
+		WHERE u.pk = $1 AND (NOT u.deals_only OR a.below_market) AND `+subscribedTo("a.place_pk")+`
+		ON CONFLICT (user_pk, announce_pk, channel_pk) DO UPDATE SET
+			deliver_after = now(), attempts = 0, claimed = NULL, sending = NULL, sent = NULL, failed = NULL, last_error = NULL
+		WHERE NOT (pollbc_outbox.claimed IS NOT NULL AND pollbc_outbox.sent IS NULL AND pollbc_outbox.failed IS NULL)`,
+		userPK, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
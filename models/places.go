@@ -1,8 +1,9 @@
 package models
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"log/slog"
 	"strconv"
 	"unicode"
 )
@@ -28,11 +29,11 @@ func (d ByArrondissement) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
 func (d ByArrondissement) Less(i, j int) bool {
 	ai, err := toInt(d[i].Arrondissement)
 	if err != nil {
-		log.Print("ByArrondissement.Less: " + err.Error())
+		slog.Warn("parsing arrondissement", "err", err)
 	}
 	aj, err := toInt(d[j].Arrondissement)
 	if err != nil {
-		log.Print("ByArrondissement.Less: " + err.Error())
+		slog.Warn("parsing arrondissement", "err", err)
 	}
 	return ai < aj
 }
@@ -58,9 +59,9 @@ func CreateTablePlaces() error {
 	return err
 }
 
-func HasPlace(place Place) (bool, error) {
+func HasPlace(ctx context.Context, place Place) (bool, error) {
 	var pk int
-	err := db.QueryRow("SELECT pk FROM pollbc_places WHERE city=$1 AND arrondissement=$2 AND department_pk=$3",
+	err := db.QueryRowContext(ctx, "SELECT pk FROM pollbc_places WHERE city=$1 AND arrondissement=$2 AND department_pk=$3",
 		place.City, place.Arrondissement, place.DepartmentPK).Scan(&pk)
 	if err == sql.ErrNoRows {
 		return false, nil
@@ -71,14 +72,14 @@ func HasPlace(place Place) (bool, error) {
 	}
 }
 
-func InsertPlace(place Place) error {
-	_, err := db.Exec("INSERT INTO pollbc_places (city, arrondissement, department_pk) VALUES ($1, $2, $3)",
+func InsertPlace(ctx context.Context, place Place) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_places (city, arrondissement, department_pk) VALUES ($1, $2, $3)",
 		place.City, place.Arrondissement, place.DepartmentPK)
 	return err
 }
 
-func SelectPlaces() ([]Place, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_places")
+func SelectPlaces(ctx context.Context) ([]Place, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM pollbc_places")
 	if err != nil {
 		return nil, err
 	}
@@ -86,8 +87,8 @@ func SelectPlaces() ([]Place, error) {
 	return scanPlaces(rows)
 }
 
-func SelectPlacesWhereDepartmentPK(dptPK int) ([]Place, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_places WHERE department_pk=$1", dptPK)
+func SelectPlacesWhereDepartmentPK(ctx context.Context, dptPK int) ([]Place, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM pollbc_places WHERE department_pk=$1", dptPK)
 	if err != nil {
 		return nil, err
 	}
@@ -112,13 +113,49 @@ func scanPlaces(rows *sql.Rows) ([]Place, error) {
 	return places, nil
 }
 
-func SelectPKFromPlaces(place Place) (pk int, err error) {
-	err = db.QueryRow("SELECT pk FROM pollbc_places WHERE city=$1 AND arrondissement=$2 AND department_pk=$3",
+func SelectPKFromPlaces(ctx context.Context, place Place) (pk int, err error) {
+	err = db.QueryRowContext(ctx, "SELECT pk FROM pollbc_places WHERE city=$1 AND arrondissement=$2 AND department_pk=$3",
 		place.City, place.Arrondissement, place.DepartmentPK).Scan(&pk)
 	return pk, err
 }
 
-func SelectDepartmentPKWherePK(pk int) (dptPK int, err error) {
-	err = db.QueryRow("SELECT department_pk FROM pollbc_places WHERE pk=$1", pk).Scan(&dptPK)
+func SelectPlaceWherePK(ctx context.Context, pk int) (place Place, err error) {
+	err = db.QueryRowContext(ctx, "SELECT * FROM pollbc_places WHERE pk=$1",
+		pk).Scan(&place.PK, &place.City, &place.Arrondissement, &place.DepartmentPK)
+	return place, err
+}
+
+func SelectDepartmentPKWherePK(ctx context.Context, pk int) (dptPK int, err error) {
+	err = db.QueryRowContext(ctx, "SELECT department_pk FROM pollbc_places WHERE pk=$1", pk).Scan(&dptPK)
 	return dptPK, err
 }
+
+// A PlaceCount is a place and its number of announces.
+type PlaceCount struct {
+	Place
+	Announces int
+}
+
+func SelectPlacesCount(ctx context.Context) ([]PlaceCount, error) {
+	rows, err := db.QueryContext(ctx, `SELECT p.pk, p.city, p.arrondissement, p.department_pk, count(a.pk)
+		FROM pollbc_places p LEFT JOIN pollbc_announces a ON a.place_pk = p.pk
+		GROUP BY p.pk ORDER BY p.pk`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var places []PlaceCount
+	for rows.Next() {
+		var p PlaceCount
+		err := rows.Scan(&p.PK, &p.City, &p.Arrondissement, &p.DepartmentPK, &p.Announces)
+		if err != nil {
+			return places, err
+		}
+
+		places = append(places, p)
+	}
+	if err := rows.Err(); err != nil {
+		return places, err
+	}
+	return places, nil
+}
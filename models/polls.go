@@ -0,0 +1,98 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// A Poll records the last fetches of a source.
+type Poll struct {
+	Source      string
+	LastAttempt time.Time
+	// LastSuccess is zero when the source was never fetched successfully.
+	LastSuccess time.Time
+	LastError   string
+}
+
+func CreateTablePolls() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_polls (
+		source text PRIMARY KEY,
+		last_attempt timestamp with time zone NOT NULL,
+		last_success timestamp with time zone,
+		last_error text
+	);`)
+	return err
+}
+
+// ClaimPoll records an attempt to fetch source, unless another process
+// attempted it less than interval ago, or less than retryInterval ago if
+// that attempt failed. It returns false if the source must not be fetched,
+// so that several pollers don't fetch the same source together.
+func ClaimPoll(ctx context.Context, source string, interval, retryInterval time.Duration) (bool, error) {
+	res, err := db.ExecContext(ctx, `INSERT INTO pollbc_polls (source, last_attempt) VALUES ($1, now())
+		ON CONFLICT (source) DO UPDATE SET last_attempt = now()
+		WHERE pollbc_polls.last_attempt <= now() - CASE WHEN pollbc_polls.last_error IS NULL
+			THEN $2 * interval '1 millisecond' ELSE $3 * interval '1 millisecond' END`,
+		source, interval.Milliseconds(), retryInterval.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecordPoll records the result of the fetch of source claimed by
+// ClaimPoll, which failed if cause is not nil.
+func RecordPoll(ctx context.Context, source string, cause error) error {
+	if cause != nil {
+		_, err := db.ExecContext(ctx, `INSERT INTO pollbc_polls (source, last_attempt, last_error) VALUES ($1, now(), $2)
+			ON CONFLICT (source) DO UPDATE SET last_error = $2`,
+			source, cause.Error())
+		return err
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO pollbc_polls (source, last_attempt, last_success) VALUES ($1, now(), now())
+		ON CONFLICT (source) DO UPDATE SET last_success = now(), last_error = NULL`,
+		source)
+	return err
+}
+
+func SelectPolls(ctx context.Context) ([]Poll, error) {
+	rows, err := db.QueryContext(ctx, `SELECT source, last_attempt, last_success, COALESCE(last_error, '')
+		FROM pollbc_polls ORDER BY source`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var polls []Poll
+	for rows.Next() {
+		var p Poll
+		var success sql.NullTime
+		err := rows.Scan(&p.Source, &p.LastAttempt, &success, &p.LastError)
+		if err != nil {
+			return polls, err
+		}
+		p.LastSuccess = success.Time
+
+		polls = append(polls, p)
+	}
+	if err := rows.Err(); err != nil {
+		return polls, err
+	}
+	return polls, nil
+}
+
+// Ping checks that the database is reachable.
+func Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// SelectLastUpdate returns the last time announces were fetched or a source
+// was polled successfully, which is zero if it never happened.
+func SelectLastUpdate(ctx context.Context) (time.Time, error) {
+	var last sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT GREATEST(
+		(SELECT max(fetched) FROM pollbc_announces),
+		(SELECT max(last_success) FROM pollbc_polls))`).Scan(&last)
+	return last.Time, err
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"context"
+	"strings"
+)
+
+type Region struct {
+	PK   int
+	Name string
+}
+
+// departmentRegions maps the names of the departments of France to the
+// name of their region.
+var departmentRegions = map[string]string{
+	"Ain":                     "Auvergne-Rhône-Alpes",
+	"Allier":                  "Auvergne-Rhône-Alpes",
+	"Ardèche":                 "Auvergne-Rhône-Alpes",
+	"Cantal":                  "Auvergne-Rhône-Alpes",
+	"Drôme":                   "Auvergne-Rhône-Alpes",
+	"Isère":                   "Auvergne-Rhône-Alpes",
+	"Loire":                   "Auvergne-Rhône-Alpes",
+	"Haute-Loire":             "Auvergne-Rhône-Alpes",
+	"Puy-de-Dôme":             "Auvergne-Rhône-Alpes",
+	"Rhône":                   "Auvergne-Rhône-Alpes",
+	"Savoie":                  "Auvergne-Rhône-Alpes",
+	"Haute-Savoie":            "Auvergne-Rhône-Alpes",
+	"Côte-d'Or":               "Bourgogne-Franche-Comté",
+	"Doubs":                   "Bourgogne-Franche-Comté",
+	"Jura":                    "Bourgogne-Franche-Comté",
+	"Nièvre":                  "Bourgogne-Franche-Comté",
+	"Haute-Saône":             "Bourgogne-Franche-Comté",
+	"Saône-et-Loire":          "Bourgogne-Franche-Comté",
+	"Yonne":                   "Bourgogne-Franche-Comté",
+	"Territoire de Belfort":   "Bourgogne-Franche-Comté",
+	"Côtes-d'Armor":           "Bretagne",
+	"Finistère":               "Bretagne",
+	"Ille-et-Vilaine":         "Bretagne",
+	"Morbihan":                "Bretagne",
+	"Cher":                    "Centre-Val de Loire",
+	"Eure-et-Loir":            "Centre-Val de Loire",
+	"Indre":                   "Centre-Val de Loire",
+	"Indre-et-Loire":          "Centre-Val de Loire",
+	"Loir-et-Cher":            "Centre-Val de Loire",
+	"Loiret":                  "Centre-Val de Loire",
+	"Corse-du-Sud":            "Corse",
+	"Haute-Corse":             "Corse",
+	"Ardennes":                "Grand Est",
+	"Aube":                    "Grand Est",
+	"Marne":                   "Grand Est",
+	"Haute-Marne":             "Grand Est",
+	"Meurthe-et-Moselle":      "Grand Est",
+	"Meuse":                   "Grand Est",
+	"Moselle":                 "Grand Est",
+	"Bas-Rhin":                "Grand Est",
+	"Haut-Rhin":               "Grand Est",
+	"Vosges":                  "Grand Est",
+	"Aisne":                   "Hauts-de-France",
+	"Nord":                    "Hauts-de-France",
+	"Oise":                    "Hauts-de-France",
+	"Pas-de-Calais":           "Hauts-de-France",
+	"Somme":                   "Hauts-de-France",
+	"Paris":                   "Île-de-France",
+	"Seine-et-Marne":          "Île-de-France",
+	"Yvelines":                "Île-de-France",
+	"Essonne":                 "Île-de-France",
+	"Hauts-de-Seine":          "Île-de-France",
+	"Seine-Saint-Denis":       "Île-de-France",
+	"Val-de-Marne":            "Île-de-France",
+	"Val-d'Oise":              "Île-de-France",
+	"Calvados":                "Normandie",
+	"Eure":                    "Normandie",
+	"Manche":                  "Normandie",
+	"Orne":                    "Normandie",
+	"Seine-Maritime":          "Normandie",
+	"Charente":                "Nouvelle-Aquitaine",
+	"Charente-Maritime":       "Nouvelle-Aquitaine",
+	"Corrèze":                 "Nouvelle-Aquitaine",
+	"Creuse":                  "Nouvelle-Aquitaine",
+	"Dordogne":                "Nouvelle-Aquitaine",
+	"Gironde":                 "Nouvelle-Aquitaine",
+	"Landes":                  "Nouvelle-Aquitaine",
+	"Lot-et-Garonne":          "Nouvelle-Aquitaine",
+	"Pyrénées-Atlantiques":    "Nouvelle-Aquitaine",
+	"Deux-Sèvres":             "Nouvelle-Aquitaine",
+	"Vienne":                  "Nouvelle-Aquitaine",
+	"Haute-Vienne":            "Nouvelle-Aquitaine",
+	"Ariège":                  "Occitanie",
+	"Aude":                    "Occitanie",
+	"Aveyron":                 "Occitanie",
+	"Gard":                    "Occitanie",
+	"Haute-Garonne":           "Occitanie",
+	"Gers":                    "Occitanie",
+	"Hérault":                 "Occitanie",
+	"Lot":                     "Occitanie",
+	"Lozère":                  "Occitanie",
+	"Hautes-Pyrénées":         "Occitanie",
+	"Pyrénées-Orientales":     "Occitanie",
+	"Tarn":                    "Occitanie",
+	"Tarn-et-Garonne":         "Occitanie",
+	"Loire-Atlantique":        "Pays de la Loire",
+	"Maine-et-Loire":          "Pays de la Loire",
+	"Mayenne":                 "Pays de la Loire",
+	"Sarthe":                  "Pays de la Loire",
+	"Vendée":                  "Pays de la Loire",
+	"Alpes-de-Haute-Provence": "Provence-Alpes-Côte d'Azur",
+	"Hautes-Alpes":            "Provence-Alpes-Côte d'Azur",
+	"Alpes-Maritimes":         "Provence-Alpes-Côte d'Azur",
+	"Bouches-du-Rhône":        "Provence-Alpes-Côte d'Azur",
+	"Var":                     "Provence-Alpes-Côte d'Azur",
+	"Vaucluse":                "Provence-Alpes-Côte d'Azur",
+	"Guadeloupe":              "Guadeloupe",
+	"Martinique":              "Martinique",
+	"Guyane":                  "Guyane",
+	"La Réunion":              "La Réunion",
+	"Mayotte":                 "Mayotte",
+}
+
+// DepartmentRegion returns the region of the department with this name, as
+// displayed by leboncoin.fr. Names are compared regardless of case, accents
+// and punctuation.
+func DepartmentRegion(name string) (string, bool) {
+	region, ok := regionsByKey[nameKey(name)]
+	return region, ok
+}
+
+var regionsByKey = func() map[string]string {
+	m := make(map[string]string, len(departmentRegions))
+	for dpt, region := range departmentRegions {
+		m[nameKey(dpt)] = region
+	}
+	return m
+}()
+
+var unaccent = strings.NewReplacer("à", "a", "â", "a", "ä", "a", "ç", "c", "é", "e", "è", "e", "ê", "e", "ë", "e",
+	"î", "i", "ï", "i", "ô", "o", "ö", "o", "ù", "u", "û", "u", "ü", "u", "ÿ", "y", "œ", "oe", "æ", "ae")
+
+// nameKey returns the lowercase letters and digits of name, without accents.
+func nameKey(name string) string {
+	name = unaccent.Replace(strings.ToLower(name))
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+func CreateTableRegions() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_regions (
+		pk serial PRIMARY KEY,
+		name text UNIQUE NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	// The region was named without its accent before it had a table.
+	_, err = db.Exec("UPDATE pollbc_regions SET name='Île-de-France' WHERE name='Ile-de-France'")
+	if err != nil {
+		return err
+	}
+	for _, name := range departmentRegions {
+		_, err = db.Exec("INSERT INTO pollbc_regions (name) VALUES ($1) ON CONFLICT DO NOTHING", name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CreateTableUsersDepartments() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_users_departments (
+		user_pk integer REFERENCES pollbc_users(pk) ON DELETE CASCADE,
+		department_pk integer REFERENCES pollbc_departements(pk),
+		PRIMARY KEY (user_pk, department_pk)
+	);`)
+	return err
+}
+
+func CreateTableUsersRegions() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_users_regions (
+		user_pk integer REFERENCES pollbc_users(pk) ON DELETE CASCADE,
+		region_pk integer REFERENCES pollbc_regions(pk),
+		PRIMARY KEY (user_pk, region_pk)
+	);`)
+	return err
+}
+
+func SelectRegions(ctx context.Context) ([]Region, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pk, name FROM pollbc_regions ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var regions []Region
+	for rows.Next() {
+		var region Region
+		err := rows.Scan(&region.PK, &region.Name)
+		if err != nil {
+			return regions, err
+		}
+
+		regions = append(regions, region)
+	}
+	if err := rows.Err(); err != nil {
+		return regions, err
+	}
+	return regions, nil
+}
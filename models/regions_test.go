@@ -0,0 +1,37 @@
+package models
+
+import "testing"
+
+func TestDepartmentRegions(t *testing.T) {
+	regions := make(map[string]int)
+	for _, region := range departmentRegions {
+		regions[region]++
+	}
+	if len(departmentRegions) != 101 || len(regions) != 18 {
+		t.Errorf("got %d departments in %d regions, want 101 in 18", len(departmentRegions), len(regions))
+	}
+	if len(regionsByKey) != len(departmentRegions) {
+		t.Errorf("got %d keys for %d departments", len(regionsByKey), len(departmentRegions))
+	}
+}
+
+func TestDepartmentRegion(t *testing.T) {
+	for name, want := range map[string]string{
+		"Paris":                 "Île-de-France",
+		"Val-d'Oise":            "Île-de-France",
+		"Val d’Oise":            "Île-de-France",
+		"Bouches-du-Rhone":      "Provence-Alpes-Côte d'Azur",
+		"CÔTES-D'ARMOR":         "Bretagne",
+		"Territoire-de-Belfort": "Bourgogne-Franche-Comté",
+		"La Réunion":            "La Réunion",
+		"Corse-du-Sud":          "Corse",
+	} {
+		got, ok := DepartmentRegion(name)
+		if !ok || got != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, ok, want)
+		}
+	}
+	if region, ok := DepartmentRegion("Monaco"); ok {
+		t.Errorf("Monaco: got %q, want no region", region)
+	}
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// ErrStaleConfirmation is returned by ConfirmSignup for the links sent
+// before the last signup or unsubscription of the user.
+var ErrStaleConfirmation = errors.New("stale confirmation")
+
+// pollbc_signups holds the subscriptions requested with the signup form,
+// which replace those of the user once confirmed. The confirm_version of a
+// user is in its confirmation links, so that only the link of the last
+// request is valid, and none is after the user unsubscribes.
+func CreateTableSignups() error {
+	_, err := db.Exec(`ALTER TABLE pollbc_users
+		ADD COLUMN IF NOT EXISTS confirm_version integer NOT NULL DEFAULT 0`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_signups (
+		user_pk integer PRIMARY KEY REFERENCES pollbc_users(pk) ON DELETE CASCADE,
+		subscriptions text NOT NULL,
+		created timestamp with time zone NOT NULL DEFAULT now()
+	);`)
+	return err
+}
+
+// RequestSignup records subs until the user confirms them, and returns the
+// version that the confirmation link must carry. The links sent before are
+// no longer valid.
+func RequestSignup(ctx context.Context, userPK int, subs Subscriptions) (int, error) {
+	b, err := json.Marshal(subs)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var version int
+	err = tx.QueryRowContext(ctx, `UPDATE pollbc_users SET confirm_version = confirm_version + 1
+		WHERE pk=$1 RETURNING confirm_version`, userPK).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO pollbc_signups (user_pk, subscriptions) VALUES ($1, $2)
+		ON CONFLICT (user_pk) DO UPDATE SET subscriptions = EXCLUDED.subscriptions, created = now()`,
+		userPK, string(b))
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// ConfirmSignup activates a user with the subscriptions it requested, if
+// version is the one of its last request.
+func ConfirmSignup(ctx context.Context, userPK, version int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var current int
+	err = tx.QueryRowContext(ctx, "SELECT confirm_version FROM pollbc_users WHERE pk=$1 FOR UPDATE",
+		userPK).Scan(&current)
+	if err == sql.ErrNoRows || err == nil && current != version {
+		return ErrStaleConfirmation
+	} else if err != nil {
+		return err
+	}
+	var s string
+	err = tx.QueryRowContext(ctx, "DELETE FROM pollbc_signups WHERE user_pk=$1 RETURNING subscriptions",
+		userPK).Scan(&s)
+	switch err {
+	case nil:
+		var subs Subscriptions
+		err = json.Unmarshal([]byte(s), &subs)
+		if err != nil {
+			return err
+		}
+		err = replaceUserSubscriptions(ctx, tx, userPK, subs)
+		if err != nil {
+			return err
+		}
+	case sql.ErrNoRows:
+		// The link was followed before, or sent before pollbc_signups.
+	default:
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE pollbc_users SET active=true WHERE pk=$1", userPK)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnsubscribeUser deactivates a user and invalidates its confirmation
+// links.
+func UnsubscribeUser(ctx context.Context, pk int) error {
+	_, err := db.ExecContext(ctx, `UPDATE pollbc_users SET active=false, confirm_version = confirm_version + 1
+		WHERE pk=$1`, pk)
+	return err
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// A Source is a search page of leboncoin to poll.
+type Source struct {
+	PK      int
+	Name    string
+	URL     string
+	Created time.Time
+}
+
+func CreateTableSources() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_sources (
+		pk serial PRIMARY KEY,
+		name text UNIQUE NOT NULL,
+		url text NOT NULL,
+		created timestamp with time zone NOT NULL DEFAULT now()
+	);`)
+	return err
+}
+
+func InsertSource(ctx context.Context, name, url string) (pk int, err error) {
+	err = db.QueryRowContext(ctx, "INSERT INTO pollbc_sources (name, url) VALUES ($1, $2) RETURNING pk",
+		name, url).Scan(&pk)
+	return
+}
+
+// SelectSources returns the sources ordered by name.
+func SelectSources(ctx context.Context) ([]Source, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pk, name, url, created FROM pollbc_sources ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sources []Source
+	for rows.Next() {
+		var s Source
+		err := rows.Scan(&s.PK, &s.Name, &s.URL, &s.Created)
+		if err != nil {
+			return sources, err
+		}
+
+		sources = append(sources, s)
+	}
+	if err := rows.Err(); err != nil {
+		return sources, err
+	}
+	return sources, nil
+}
+
+// SelectSourceWhereName returns sql.ErrNoRows if there is no source with
+// this name.
+func SelectSourceWhereName(ctx context.Context, name string) (s Source, err error) {
+	err = db.QueryRowContext(ctx, "SELECT pk, name, url, created FROM pollbc_sources WHERE name=$1",
+		name).Scan(&s.PK, &s.Name, &s.URL, &s.Created)
+	return
+}
+
+func DeleteSource(ctx context.Context, name string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM pollbc_sources WHERE name=$1", name)
+	return err
+}
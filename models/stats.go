@@ -0,0 +1,312 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pollbc_stats_daily rolls up the announces posted each day in each place:
+// their number and their number per hour of the day, in the time zone loc.
+// pollbc_stats_prices counts their prices in buckets of priceBucket euros.
+// InsertAnnounce maintains them, and they outlive the announces.
+func CreateTableStats(loc *time.Location) error {
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass('pollbc_stats_daily') IS NOT NULL").Scan(&exists)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_stats_daily (
+		day date NOT NULL,
+		place_pk integer NOT NULL REFERENCES pollbc_places(pk),
+		announces integer NOT NULL,
+		hours integer[] NOT NULL,
+		PRIMARY KEY (day, place_pk)
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pollbc_stats_prices (
+		day date NOT NULL,
+		place_pk integer NOT NULL,
+		bucket integer NOT NULL,
+		count integer NOT NULL,
+		PRIMARY KEY (day, place_pk, bucket),
+		FOREIGN KEY (day, place_pk) REFERENCES pollbc_stats_daily ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if exists {
+		// Earlier versions kept every price in an array.
+		var prices bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'pollbc_stats_daily' AND column_name = 'prices')`).Scan(&prices)
+		if err != nil || !prices {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO pollbc_stats_prices (day, place_pk, bucket, count)
+			SELECT s.day, s.place_pk, u.price / $1, count(*)
+			FROM pollbc_stats_daily s, unnest(s.prices) AS u(price)
+			GROUP BY 1, 2, 3
+			ON CONFLICT DO NOTHING`, priceBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE pollbc_stats_daily DROP COLUMN prices")
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// Roll up the announces inserted before the tables.
+	_, err = tx.Exec(`WITH a AS (
+			SELECT (date AT TIME ZONE $1::text)::date AS day, place_pk,
+				extract(hour FROM date AT TIME ZONE $1::text)::integer + 1 AS hour
+			FROM pollbc_announces),
+		h AS (SELECT day, place_pk, hour, count(*)::integer AS n FROM a GROUP BY 1, 2, 3)
+		INSERT INTO pollbc_stats_daily (day, place_pk, announces, hours)
+		SELECT k.day, k.place_pk, sum(COALESCE(h.n, 0))::integer, array_agg(COALESCE(h.n, 0) ORDER BY g)
+		FROM (SELECT DISTINCT day, place_pk FROM h) k
+		CROSS JOIN generate_series(1, 24) g
+		LEFT JOIN h ON h.day = k.day AND h.place_pk = k.place_pk AND h.hour = g
+		GROUP BY k.day, k.place_pk`, loc.String())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO pollbc_stats_prices (day, place_pk, bucket, count)
+		SELECT (date AT TIME ZONE $2::text)::date, place_pk, price_value / $1, count(*)
+		FROM pollbc_announces
+		WHERE price_value > 0
+		GROUP BY 1, 2, 3`, priceBucket, loc.String())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// priceBucket is the width in euros of the buckets of pollbc_stats_prices.
+const priceBucket = 10
+
+// rollupAnnounce adds ann to pollbc_stats_daily and pollbc_stats_prices, in
+// the time zone loc.
+func rollupAnnounce(ctx context.Context, tx *sql.Tx, ann Announce, loc *time.Location) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO pollbc_stats_daily AS s (day, place_pk, announces, hours)
+		SELECT d.day, $2, 1,
+			(SELECT array_agg(CASE WHEN h = d.hour THEN 1 ELSE 0 END ORDER BY h) FROM generate_series(1, 24) h)
+		FROM (SELECT ($1::timestamptz AT TIME ZONE $3::text)::date AS day,
+			extract(hour FROM $1::timestamptz AT TIME ZONE $3::text)::integer + 1 AS hour) d
+		ON CONFLICT (day, place_pk) DO UPDATE SET
+			announces = s.announces + 1,
+			hours = (SELECT array_agg(s.hours[h] + EXCLUDED.hours[h] ORDER BY h) FROM generate_series(1, 24) h)`,
+		ann.Date, ann.PlacePK, loc.String())
+	if err != nil || ann.PriceValue <= 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO pollbc_stats_prices AS p (day, place_pk, bucket, count)
+		VALUES (($1::timestamptz AT TIME ZONE $5::text)::date, $2, $3::integer / $4, 1)
+		ON CONFLICT (day, place_pk, bucket) DO UPDATE SET count = p.count + 1`,
+		ann.Date, ann.PlacePK, ann.PriceValue, priceBucket, loc.String())
+	return err
+}
+
+// quantile returns an expression of the fraction f of the prices counted by
+// the rows of a group. Rows have the columns bucket, n, its count, below,
+// the count of the lower buckets, and total, the count of the group. Prices
+// are taken as evenly spread in their bucket.
+func quantile(f string) string {
+	return `min(CASE WHEN below + n >= ` + f + ` * total
+		THEN (bucket + greatest(` + f + ` * total - below, 0) / n) * ` + strconv.Itoa(priceBucket) + ` END)::float8`
+}
+
+// A StatsFilter selects the rolled up announces in one of PlacePKs, or in
+// one of DepartmentPKs where none of PlacePKs is, posted between From
+// (included) and To (excluded). Zero fields don't filter, except Location,
+// the time zone of the rollups, which is UTC if nil.
+type StatsFilter struct {
+	PlacePKs      []int
+	DepartmentPKs []int
+	From          time.Time
+	To            time.Time
+	Location      *time.Location
+}
+
+// query returns a query of the rollups selected by f, and its arguments.
+func (f StatsFilter) query() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if cond, placeArgs := placesCond("s.place_pk", f.PlacePKs, f.DepartmentPKs, 1); cond != "" {
+		conds = append(conds, cond)
+		args = append(args, placeArgs...)
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From, f.Location.String())
+		conds = append(conds, "s.day >= ($"+strconv.Itoa(len(args)-1)+"::timestamptz AT TIME ZONE $"+strconv.Itoa(len(args))+"::text)::date")
+	}
+	if !f.To.IsZero() {
+		// To is excluded: the day of To is included only if it doesn't
+		// start at To.
+		args = append(args, f.To, f.Location.String())
+		conds = append(conds, "s.day < ($"+strconv.Itoa(len(args)-1)+"::timestamptz AT TIME ZONE $"+strconv.Itoa(len(args))+"::text)")
+	}
+	query := `SELECT s.day, s.place_pk, pl.department_pk, s.announces, s.hours
+		FROM pollbc_stats_daily s JOIN pollbc_places pl ON pl.pk = s.place_pk`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return query, args
+}
+
+// PriceStats are the number of announces of a group and the quartiles of
+// their prices. Prices is the number of announces with a price; the
+// quartiles are 0 if there is none. The quartiles are accurate to
+// priceBucket euros.
+type PriceStats struct {
+	Announces int
+	Prices    int
+	Q1        float64
+	Median    float64
+	Q3        float64
+}
+
+func (p *PriceStats) dest() []interface{} {
+	return []interface{}{&p.Announces, &p.Prices, &p.Q1, &p.Median, &p.Q3}
+}
+
+// priceStatsQuery returns a query of the price stats of the rollups
+// selected by f grouped by key, a column of StatsFilter.query, and its
+// arguments. Rows are key, then the columns of PriceStats.dest.
+func priceStatsQuery(key string, f StatsFilter) (string, []interface{}) {
+	query, args := f.query()
+	return `WITH s AS (` + query + `),
+		b AS (SELECT s.` + key + `, p.bucket, sum(p.count) AS n
+			FROM s JOIN pollbc_stats_prices p ON p.day = s.day AND p.place_pk = s.place_pk
+			GROUP BY 1, 2),
+		c AS (SELECT ` + key + `, bucket, n,
+			sum(n) OVER (PARTITION BY ` + key + ` ORDER BY bucket) - n AS below,
+			sum(n) OVER (PARTITION BY ` + key + `) AS total
+			FROM b),
+		q AS (SELECT ` + key + `, max(total)::integer AS prices,
+			` + quantile("0.25") + ` AS q1, ` + quantile("0.5") + ` AS median, ` + quantile("0.75") + ` AS q3
+			FROM c GROUP BY 1)
+		SELECT a.` + key + `, a.announces, COALESCE(q.prices, 0),
+			COALESCE(q.q1, 0), COALESCE(q.median, 0), COALESCE(q.q3, 0)
+		FROM (SELECT ` + key + `, sum(announces)::integer AS announces FROM s GROUP BY ` + key + `) a
+		LEFT JOIN q USING (` + key + `)
+		ORDER BY a.` + key, args
+}
+
+type DayStats struct {
+	Day time.Time
+	PriceStats
+}
+
+// SelectDayStats returns the stats of each day with announces.
+func SelectDayStats(ctx context.Context, f StatsFilter) ([]DayStats, error) {
+	query, args := priceStatsQuery("day", f)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []DayStats
+	for rows.Next() {
+		var d DayStats
+		err := rows.Scan(append([]interface{}{&d.Day}, d.dest()...)...)
+		if err != nil {
+			return days, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+type PlaceStats struct {
+	PlacePK int
+	PriceStats
+}
+
+// SelectPlaceStats returns the stats of each place with announces.
+func SelectPlaceStats(ctx context.Context, f StatsFilter) ([]PlaceStats, error) {
+	query, args := priceStatsQuery("place_pk", f)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var places []PlaceStats
+	for rows.Next() {
+		var p PlaceStats
+		err := rows.Scan(append([]interface{}{&p.PlacePK}, p.dest()...)...)
+		if err != nil {
+			return places, err
+		}
+		places = append(places, p)
+	}
+	return places, rows.Err()
+}
+
+type DepartmentStats struct {
+	DepartmentPK int
+	PriceStats
+}
+
+// SelectDepartmentStats returns the stats of each department with
+// announces.
+func SelectDepartmentStats(ctx context.Context, f StatsFilter) ([]DepartmentStats, error) {
+	query, args := priceStatsQuery("department_pk", f)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var dpts []DepartmentStats
+	for rows.Next() {
+		var d DepartmentStats
+		err := rows.Scan(append([]interface{}{&d.DepartmentPK}, d.dest()...)...)
+		if err != nil {
+			return dpts, err
+		}
+		dpts = append(dpts, d)
+	}
+	return dpts, rows.Err()
+}
+
+// PostingStats are the numbers of announces posted on each weekday and at
+// each hour, in the time zone of the rollups.
+type PostingStats struct {
+	Weekdays [7]int // indexed by time.Weekday
+	Hours    [24]int
+}
+
+func SelectPostingStats(ctx context.Context, f StatsFilter) (PostingStats, error) {
+	var stats PostingStats
+	query, args := f.query()
+	rows, err := db.QueryContext(ctx, `WITH s AS (`+query+`)
+		SELECT extract(dow FROM s.day)::integer, h - 1, sum(s.hours[h])::integer
+		FROM s, generate_series(1, 24) h
+		GROUP BY 1, 2`, args...)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var weekday, hour, count int
+		err := rows.Scan(&weekday, &hour, &count)
+		if err != nil {
+			return stats, err
+		}
+		stats.Weekdays[weekday] += count
+		stats.Hours[hour] += count
+	}
+	return stats, rows.Err()
+}
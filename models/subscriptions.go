@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Subscriptions are the places, departments and regions a user is notified
+// of. Subscribing to a department or a region includes the places that will
+// be discovered later.
+type Subscriptions struct {
+	PlacePKs      []int
+	DepartmentPKs []int
+	RegionPKs     []int
+}
+
+func (s Subscriptions) Empty() bool {
+	return len(s.PlacePKs) == 0 && len(s.DepartmentPKs) == 0 && len(s.RegionPKs) == 0
+}
+
+// ReplaceUserSubscriptions sets the subscriptions of a user.
+func ReplaceUserSubscriptions(ctx context.Context, userPK int, subs Subscriptions) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = replaceUserSubscriptions(ctx, tx, userPK, subs)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceUserSubscriptions(ctx context.Context, tx *sql.Tx, userPK int, subs Subscriptions) error {
+	for _, table := range []string{"pollbc_users_places", "pollbc_users_departments", "pollbc_users_regions"} {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_pk=$1", userPK)
+		if err != nil {
+			return err
+		}
+	}
+	for _, placePK := range subs.PlacePKs {
+		_, err := tx.ExecContext(ctx, "INSERT INTO pollbc_users_places (user_pk, place_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userPK, placePK)
+		if err != nil {
+			return err
+		}
+	}
+	for _, dptPK := range subs.DepartmentPKs {
+		_, err := tx.ExecContext(ctx, "INSERT INTO pollbc_users_departments (user_pk, department_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userPK, dptPK)
+		if err != nil {
+			return err
+		}
+	}
+	for _, regionPK := range subs.RegionPKs {
+		_, err := tx.ExecContext(ctx, "INSERT INTO pollbc_users_regions (user_pk, region_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			userPK, regionPK)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SelectUserSubscriptions(ctx context.Context, userPK int) (Subscriptions, error) {
+	var subs Subscriptions
+	var err error
+	subs.PlacePKs, err = SelectPlacesPKWhereUserPK(ctx, userPK)
+	if err != nil {
+		return subs, err
+	}
+	subs.DepartmentPKs, err = selectInts(ctx, "SELECT department_pk FROM pollbc_users_departments WHERE user_pk=$1", userPK)
+	if err != nil {
+		return subs, err
+	}
+	subs.RegionPKs, err = selectInts(ctx, "SELECT region_pk FROM pollbc_users_regions WHERE user_pk=$1", userPK)
+	return subs, err
+}
+
+func InsertUserDepartment(ctx context.Context, userPK, dptPK int) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_users_departments (user_pk, department_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userPK, dptPK)
+	return err
+}
+
+func DeleteUserDepartment(ctx context.Context, userPK, dptPK int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM pollbc_users_departments WHERE user_pk=$1 AND department_pk=$2",
+		userPK, dptPK)
+	return err
+}
+
+func InsertUserRegion(ctx context.Context, userPK, regionPK int) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_users_regions (user_pk, region_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userPK, regionPK)
+	return err
+}
+
+func DeleteUserRegion(ctx context.Context, userPK, regionPK int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM pollbc_users_regions WHERE user_pk=$1 AND region_pk=$2",
+		userPK, regionPK)
+	return err
+}
+
+// subscribedTo returns the condition on a pollbc_users u that it is
+// subscribed to place, directly or through its department or region. place
+// is a placeholder or a column.
+func subscribedTo(place string) string {
+	return `(
+	EXISTS (SELECT 1 FROM pollbc_users_places up
+		WHERE up.user_pk = u.pk AND up.place_pk = ` + place + `)
+	OR EXISTS (SELECT 1 FROM pollbc_users_departments ud
+		JOIN pollbc_places p ON p.department_pk = ud.department_pk
+		WHERE ud.user_pk = u.pk AND p.pk = ` + place + `)
+	OR EXISTS (SELECT 1 FROM pollbc_users_regions ur
+		JOIN pollbc_departements d ON d.region_pk = ur.region_pk
+		JOIN pollbc_places p ON p.department_pk = d.pk
+		WHERE ur.user_pk = u.pk AND p.pk = ` + place + `))`
+}
+
+func selectInts(ctx context.Context, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ints []int
+	for rows.Next() {
+		var i int
+		err := rows.Scan(&i)
+		if err != nil {
+			return ints, err
+		}
+
+		ints = append(ints, i)
+	}
+	if err := rows.Err(); err != nil {
+		return ints, err
+	}
+	return ints, nil
+}
@@ -1,8 +1,118 @@
 package models
 
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Notification frequencies.
+const (
+	FrequencyImmediate = "immediate"
+	FrequencyHourly    = "hourly"
+	FrequencyDaily     = "daily"
+)
+
 type User struct {
-	PK    int
-	Email string
+	PK        int
+	Email     string
+	Active    bool
+	Frequency string
+
+	// DigestSent is when the last hourly or daily digest was sent.
+	DigestSent time.Time
+
+	// Timezone is the name of the location of the user. No notification is
+	// delivered from QuietStart to QuietEnd, which are hours in this
+	// location. There are no quiet hours when they are equal.
+	Timezone   string
+	QuietStart int
+	QuietEnd   int
+
+	// DealsOnly is true if the user is notified of the announces below
+	// market only.
+	DealsOnly bool
+}
+
+// DefaultTimezone is the timezone of new users.
+const DefaultTimezone = "Europe/Paris"
+
+// Location returns the location of the user, or the one of DefaultTimezone
+// if Timezone is invalid.
+func (u User) Location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		loc, err = time.LoadLocation(DefaultTimezone)
+	}
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// DigestPeriod returns the time between two digests, or 0 if the user is
+// notified immediately.
+func (u User) DigestPeriod() time.Duration {
+	switch u.Frequency {
+	case FrequencyHourly:
+		return time.Hour
+	case FrequencyDaily:
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// NextDelivery returns when announces found at now should be delivered:
+// after the current digest period, and at the end of quiet hours. All the
+// announces found during the same quiet hours get the same time, so they are
+// delivered together.
+func (u User) NextDelivery(now time.Time) time.Time {
+	next := u.DigestSent.Add(u.DigestPeriod())
+	if next.Before(now) {
+		next = now
+	}
+	if u.QuietStart == u.QuietEnd {
+		return next
+	}
+
+	t := next.In(u.Location())
+	h := t.Hour()
+	var quiet bool
+	if u.QuietStart < u.QuietEnd {
+		quiet = u.QuietStart <= h && h < u.QuietEnd
+	} else {
+		quiet = h >= u.QuietStart || h < u.QuietEnd
+	}
+	if !quiet {
+		return next
+	}
+	end := time.Date(t.Year(), t.Month(), t.Day(), u.QuietEnd, 0, 0, 0, t.Location())
+	if !end.After(t) {
+		end = time.Date(t.Year(), t.Month(), t.Day()+1, u.QuietEnd, 0, 0, 0, t.Location())
+	}
+	return end
+}
+
+const userColumns = "pk, email, active, frequency, digest_sent, timezone, quiet_start, quiet_end, deals_only"
+
+// prefixColumns qualifies each column of a comma-separated list.
+func prefixColumns(prefix, columns string) string {
+	return prefix + strings.Replace(columns, ", ", ", "+prefix, -1)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// dest returns the destinations to scan userColumns into.
+func (u *User) dest() []interface{} {
+	return []interface{}{&u.PK, &u.Email, &u.Active, &u.Frequency, &u.DigestSent, &u.Timezone, &u.QuietStart, &u.QuietEnd, &u.DealsOnly}
+}
+
+func scanUser(s scanner) (user User, err error) {
+	err = s.Scan(user.dest()...)
+	return user, err
 }
 
 func CreateTableUsers() error {
@@ -10,6 +120,18 @@ func CreateTableUsers() error {
 		pk serial PRIMARY KEY,
 		email text UNIQUE NOT NULL
 	);`)
+	if err != nil {
+		return err
+	}
+	// Users inserted by hand before self-service signup existed are active.
+	_, err = db.Exec(`ALTER TABLE pollbc_users
+		ADD COLUMN IF NOT EXISTS active boolean NOT NULL DEFAULT true,
+		ADD COLUMN IF NOT EXISTS frequency text NOT NULL DEFAULT 'immediate',
+		ADD COLUMN IF NOT EXISTS digest_sent timestamp with time zone NOT NULL DEFAULT now(),
+		ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT 'Europe/Paris',
+		ADD COLUMN IF NOT EXISTS quiet_start smallint NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS quiet_end smallint NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS deals_only boolean NOT NULL DEFAULT false;`)
 	return err
 }
 
@@ -22,16 +144,30 @@ func CreateTableUsersPlaces() error {
 	return err
 }
 
-func SelectUsers() ([]User, error) {
-	rows, err := db.Query("SELECT * FROM pollbc_users")
+// SelectUsers returns the active users.
+func SelectUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+userColumns+" FROM pollbc_users WHERE active")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// SelectAllUsers returns the active and inactive users, ordered by email.
+func SelectAllUsers(ctx context.Context) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+userColumns+" FROM pollbc_users ORDER BY email")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func scanUsers(rows *sql.Rows) ([]User, error) {
 	var users []User
 	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.PK, &user.Email)
+		user, err := scanUser(rows)
 		if err != nil {
 			return users, err
 		}
@@ -44,24 +180,144 @@ func SelectUsers() ([]User, error) {
 	return users, nil
 }
 
-func SelectPlacesPKWhereUserPK(pk int) ([]int, error) {
-	rows, err := db.Query("SELECT place_pk FROM pollbc_users_places WHERE user_pk = $1", pk)
+func SelectUserWherePK(ctx context.Context, pk int) (User, error) {
+	return scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM pollbc_users WHERE pk=$1", pk))
+}
+
+// SelectUserWhereEmail returns sql.ErrNoRows if there is no user with this
+// email.
+func SelectUserWhereEmail(ctx context.Context, email string) (User, error) {
+	return scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM pollbc_users WHERE email=$1", email))
+}
+
+// InsertUser inserts an inactive user notified by email and returns its pk.
+func InsertUser(ctx context.Context, email string) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer rows.Close()
-	var placesPKs []int
-	for rows.Next() {
-		var placePK int
-		err := rows.Scan(&placePK)
-		if err != nil {
-			return placesPKs, err
-		}
+	defer tx.Rollback()
+	pk, err := insertUser(ctx, tx, email, false)
+	if err != nil {
+		return 0, err
+	}
+	return pk, tx.Commit()
+}
 
-		placesPKs = append(placesPKs, placePK)
+// InsertActiveUser inserts an active user notified by email, with its
+// subscriptions, and returns its pk. Nothing is inserted if it fails.
+func InsertActiveUser(ctx context.Context, email string, subs Subscriptions) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
-	if err := rows.Err(); err != nil {
-		return placesPKs, err
+	defer tx.Rollback()
+	pk, err := insertUser(ctx, tx, email, true)
+	if err != nil {
+		return 0, err
+	}
+	err = replaceUserSubscriptions(ctx, tx, pk, subs)
+	if err != nil {
+		return 0, err
+	}
+	return pk, tx.Commit()
+}
+
+func insertUser(ctx context.Context, tx *sql.Tx, email string, active bool) (int, error) {
+	var pk int
+	err := tx.QueryRowContext(ctx, "INSERT INTO pollbc_users (email, active) VALUES ($1, $2) RETURNING pk",
+		email, active).Scan(&pk)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO pollbc_channels (user_pk, kind, target) VALUES ($1, $2, $3)",
+		pk, ChannelEmail, email)
+	return pk, err
+}
+
+// DeleteUser deletes a user with its subscriptions, channels and outbox.
+func DeleteUser(ctx context.Context, pk int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// pollbc_users_places predates ON DELETE CASCADE.
+	_, err = tx.ExecContext(ctx, "DELETE FROM pollbc_users_places WHERE user_pk=$1", pk)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM pollbc_users WHERE pk=$1", pk)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func UpdateUserActive(ctx context.Context, pk int, active bool) error {
+	_, err := db.ExecContext(ctx, "UPDATE pollbc_users SET active=$2 WHERE pk=$1", pk, active)
+	return err
+}
+
+// UpdateUserFrequency sets the frequency of a user, and reschedules the
+// notifications not delivered yet.
+func UpdateUserFrequency(ctx context.Context, pk int, frequency string) error {
+	return updateUserSchedule(ctx, pk, "frequency=$2", frequency)
+}
+
+func UpdateUserDealsOnly(ctx context.Context, pk int, dealsOnly bool) error {
+	_, err := db.ExecContext(ctx, "UPDATE pollbc_users SET deals_only=$2 WHERE pk=$1", pk, dealsOnly)
+	return err
+}
+
+// UpdateUserSchedule sets the timezone and quiet hours of a user, and
+// reschedules the notifications not delivered yet.
+func UpdateUserSchedule(ctx context.Context, pk int, timezone string, quietStart, quietEnd int) error {
+	return updateUserSchedule(ctx, pk, "timezone=$2, quiet_start=$3, quiet_end=$4", timezone, quietStart, quietEnd)
+}
+
+// updateUserSchedule sets columns of a user that NextDelivery depends on,
+// and delivers the notifications not claimed yet at the next delivery of
+// the updated user. Those retried after a failure are not delivered before
+// the end of their backoff.
+func updateUserSchedule(ctx context.Context, pk int, set string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
-	return placesPKs, nil
+	defer tx.Rollback()
+	user, err := scanUser(tx.QueryRowContext(ctx, "UPDATE pollbc_users SET "+set+" WHERE pk=$1 RETURNING "+userColumns,
+		append([]interface{}{pk}, args...)...))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE pollbc_outbox SET
+			deliver_after = CASE WHEN attempts = 0 THEN $2 ELSE GREATEST(deliver_after, $2) END
+		WHERE user_pk = $1 AND claimed IS NULL AND sent IS NULL AND failed IS NULL`,
+		pk, user.NextDelivery(time.Now()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func UpdateUserDigestSent(ctx context.Context, pk int, sent time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE pollbc_users SET digest_sent=$2 WHERE pk=$1", pk, sent)
+	return err
+}
+
+func InsertUserPlace(ctx context.Context, userPK, placePK int) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pollbc_users_places (user_pk, place_pk) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		userPK, placePK)
+	return err
+}
+
+func DeleteUserPlace(ctx context.Context, userPK, placePK int) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM pollbc_users_places WHERE user_pk=$1 AND place_pk=$2",
+		userPK, placePK)
+	return err
+}
+
+func SelectPlacesPKWhereUserPK(ctx context.Context, pk int) ([]int, error) {
+	return selectInts(ctx, "SELECT place_pk FROM pollbc_users_places WHERE user_pk = $1", pk)
 }
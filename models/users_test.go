@@ -0,0 +1,74 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextDelivery(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, paris)
+	}
+	for _, tt := range []struct {
+		name string
+		user User
+		now  time.Time
+		want time.Time
+	}{
+		{"immediate", User{}, at(2024, 5, 1, 23, 0), at(2024, 5, 1, 23, 0)},
+		{"hourly digest", User{Frequency: FrequencyHourly, DigestSent: at(2024, 5, 1, 10, 0)},
+			at(2024, 5, 1, 10, 30), at(2024, 5, 1, 11, 0)},
+		{"hourly digest due", User{Frequency: FrequencyHourly, DigestSent: at(2024, 5, 1, 10, 0)},
+			at(2024, 5, 1, 11, 0), at(2024, 5, 1, 11, 0)},
+		{"hourly digest late", User{Frequency: FrequencyHourly, DigestSent: at(2024, 5, 1, 10, 0)},
+			at(2024, 5, 1, 12, 15), at(2024, 5, 1, 12, 15)},
+		{"daily digest", User{Frequency: FrequencyDaily, DigestSent: at(2024, 5, 1, 8, 0)},
+			at(2024, 5, 1, 20, 0), at(2024, 5, 2, 8, 0)},
+
+		{"before quiet hours", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 1, 21, 59), at(2024, 5, 1, 21, 59)},
+		{"quiet hours start", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 1, 22, 0), at(2024, 5, 2, 7, 0)},
+		{"quiet hours before midnight", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 1, 23, 30), at(2024, 5, 2, 7, 0)},
+		{"quiet hours after midnight", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 2, 3, 0), at(2024, 5, 2, 7, 0)},
+		{"quiet hours end", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 2, 7, 0), at(2024, 5, 2, 7, 0)},
+		{"quiet hours within a day", User{Timezone: "Europe/Paris", QuietStart: 1, QuietEnd: 5},
+			at(2024, 5, 2, 0, 30), at(2024, 5, 2, 0, 30)},
+		{"quiet hours within a day end", User{Timezone: "Europe/Paris", QuietStart: 1, QuietEnd: 5},
+			at(2024, 5, 2, 4, 59), at(2024, 5, 2, 5, 0)},
+		{"quiet hours of the user", User{Timezone: "America/New_York", QuietStart: 22, QuietEnd: 7},
+			time.Date(2024, 5, 2, 3, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 11, 0, 0, 0, time.UTC)},
+		{"invalid timezone", User{Timezone: "Europe/Nowhere", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 1, 23, 0), at(2024, 5, 2, 7, 0)},
+
+		// Europe/Paris goes from 02:00 CET to 03:00 CEST on 31 March 2024,
+		// and from 03:00 CEST to 02:00 CET on 27 October 2024.
+		{"spring forward", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 3, 30, 23, 0), time.Date(2024, 3, 31, 5, 0, 0, 0, time.UTC)},
+		{"spring forward skipped end", User{Timezone: "Europe/Paris", QuietStart: 0, QuietEnd: 2},
+			at(2024, 3, 31, 0, 30), time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC)},
+		{"fall back", User{Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 10, 26, 23, 0), time.Date(2024, 10, 27, 6, 0, 0, 0, time.UTC)},
+		{"fall back repeated hour", User{Timezone: "Europe/Paris", QuietStart: 2, QuietEnd: 3},
+			time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC), time.Date(2024, 10, 27, 2, 0, 0, 0, time.UTC)},
+
+		{"digest in quiet hours", User{Frequency: FrequencyDaily, DigestSent: at(2024, 5, 1, 23, 30),
+			Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 2, 9, 0), at(2024, 5, 3, 7, 0)},
+		{"digest after quiet hours", User{Frequency: FrequencyHourly, DigestSent: at(2024, 5, 2, 6, 30),
+			Timezone: "Europe/Paris", QuietStart: 22, QuietEnd: 7},
+			at(2024, 5, 2, 6, 45), at(2024, 5, 2, 7, 30)},
+	} {
+		got := tt.user.NextDelivery(tt.now)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want.In(paris))
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yansal/pollbc/email"
+	"github.com/yansal/pollbc/models"
+)
+
+// A Notifier delivers new announces to a user through one channel.
+type Notifier interface {
+	Notify(ctx context.Context, user models.User, announces []models.Announce) error
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// publicClient posts to the URLs given by users. It refuses to connect to
+// private addresses, so that users can't make the server reach the
+// services of its network. The addresses are checked once resolved, which
+// also covers redirects and DNS names pointing to private addresses.
+var publicClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var errPrivateAddress = errors.New("private address")
+
+// publicOnly is a net.Dialer Control that fails for addresses that are not
+// public.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// cgnat is the shared address space of RFC 6598.
+var cgnat = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified() && !cgnat.Contains(ip)
+}
+
+// newNotifier returns the Notifier for ch.
+func (a *app) newNotifier(ch models.Channel) (Notifier, error) {
+	switch ch.Kind {
+	case models.ChannelEmail:
+		return &emailNotifier{transport: a.mailTransport, from: a.mailFrom, to: ch.Target, unsubscribeURL: a.unsubscribeURL(ch.UserPK)}, nil
+	case models.ChannelWebhook:
+		return &webhookNotifier{client: publicClient, url: ch.Target}, nil
+	case models.ChannelSlack:
+		return &slackNotifier{client: publicClient, url: ch.Target}, nil
+	case models.ChannelTelegram:
+		return &telegramNotifier{client: httpClient, apiURL: "https://api.telegram.org", token: a.cfg.TelegramBotToken, chatID: ch.Target}, nil
+	}
+	return nil, fmt.Errorf("newNotifier: unknown channel kind %q", ch.Kind)
+}
+
+// validateChannel checks that the target of ch makes sense for its kind.
+func (a *app) validateChannel(ch models.Channel) error {
+	switch ch.Kind {
+	case models.ChannelEmail:
+		_, err := mail.ParseAddress(ch.Target)
+		return err
+	case models.ChannelWebhook, models.ChannelSlack:
+		u, err := url.Parse(ch.Target)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("validateChannel: %q is not an http(s) URL", ch.Target)
+		}
+		// Deliveries check the resolved addresses too.
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && !isPublicIP(ip) {
+			return fmt.Errorf("validateChannel: %q is not a public URL", ch.Target)
+		}
+		return nil
+	case models.ChannelTelegram:
+		if a.cfg.TelegramBotToken == "" {
+			return errors.New("validateChannel: telegram is not configured")
+		}
+		if _, err := strconv.ParseInt(ch.Target, 10, 64); err != nil && !strings.HasPrefix(ch.Target, "@") {
+			return fmt.Errorf("validateChannel: %q is not a telegram chat id", ch.Target)
+		}
+		return nil
+	}
+	return fmt.Errorf("validateChannel: unknown channel kind %q", ch.Kind)
+}
+
+// emailNotifier sends template.mail.txt and template.mail.html, or their
+// digest variants to users who receive digests.
+type emailNotifier struct {
+	transport      *email.Transport
+	from           mail.Address
+	to             string
+	unsubscribeURL string
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, user models.User, announces []models.Announce) error {
+	groups, err := groupByPlace(ctx, announces)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		User           models.User
+		Announces      []models.Announce
+		Groups         []digestGroup
+		Location       *time.Location
+		UnsubscribeURL string
+	}{user, announces, groups, user.Location(), n.unsubscribeURL}
+	textFile, htmlFile := "template.mail.txt", "template.mail.html"
+	if user.DigestPeriod() != 0 {
+		textFile, htmlFile = "template.digest.txt", "template.digest.html"
+	}
+	msg, err := newMessage(n.from, n.to, textFile, htmlFile, data)
+	if err != nil {
+		return err
+	}
+	msg.Header = map[string]string{
+		"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	return n.transport.Send(ctx, msg)
+}
+
+type webhookAnnounce struct {
+	URL         string    `json:"url"`
+	Title       string    `json:"title"`
+	Price       string    `json:"price,omitempty"`
+	Date        time.Time `json:"date"`
+	BelowMarket bool      `json:"below_market"`
+}
+
+// webhookNotifier posts the announces as JSON to an arbitrary URL.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, user models.User, announces []models.Announce) error {
+	payload := struct {
+		Email     string            `json:"email"`
+		Announces []webhookAnnounce `json:"announces"`
+	}{Email: user.Email}
+	for _, ann := range announces {
+		payload.Announces = append(payload.Announces, webhookAnnounce{ann.URL, ann.Title, ann.Price, ann.Date, ann.BelowMarket})
+	}
+	return postJSON(ctx, n.client, n.url, payload)
+}
+
+// slackNotifier posts to a Slack-compatible incoming webhook.
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, user models.User, announces []models.Announce) error {
+	var lines []string
+	for _, ann := range announces {
+		line := fmt.Sprintf("<%s|%s>", ann.URL, slackEscape(ann.Title))
+		if ann.Price != "" {
+			line += " " + slackEscape(ann.Price)
+		}
+		lines = append(lines, line)
+	}
+	payload := struct {
+		Text string `json:"text"`
+	}{announcesSummary(announces) + "\n" + strings.Join(lines, "\n")}
+	return postJSON(ctx, n.client, n.url, payload)
+}
+
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// telegramNotifier sends a message with the Telegram bot API.
+type telegramNotifier struct {
+	client *http.Client
+	apiURL string
+	token  string
+	chatID string
+}
+
+func (n *telegramNotifier) Notify(ctx context.Context, user models.User, announces []models.Announce) error {
+	var lines []string
+	for _, ann := range announces {
+		line := ann.Title
+		if ann.Price != "" {
+			line += " - " + ann.Price
+		}
+		lines = append(lines, line+"\n"+ann.URL)
+	}
+	payload := struct {
+		ChatID                string `json:"chat_id"`
+		Text                  string `json:"text"`
+		DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+	}{n.chatID, announcesSummary(announces) + "\n\n" + strings.Join(lines, "\n\n"), true}
+	err := postJSON(ctx, n.client, n.apiURL+"/bot"+n.token+"/sendMessage", payload)
+	if err != nil && n.token != "" {
+		// Don't leak the bot token in logs.
+		return errors.New(strings.Replace(err.Error(), n.token, "<token>", -1))
+	}
+	return err
+}
+
+func announcesSummary(announces []models.Announce) string {
+	if len(announces) == 1 {
+		return "1 new announce from leboncoin.fr"
+	}
+	return fmt.Sprintf("%d new announces from leboncoin.fr", len(announces))
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("postJSON: %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+var testAnnounces = []models.Announce{
+	{URL: "http://www.leboncoin.fr/colocations/1.htm", Title: "Chambre <meublée> & calme", Price: "500 €",
+		Date: time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC), BelowMarket: true},
+	{URL: "http://www.leboncoin.fr/colocations/2.htm", Title: "Colocation", Date: time.Date(2016, 5, 1, 13, 0, 0, 0, time.UTC)},
+}
+
+// recorder is a server that records the requests it receives.
+type recorder struct {
+	*httptest.Server
+	status int
+	paths  []string
+	bodies [][]byte
+}
+
+func newRecorder(t *testing.T, status int) *recorder {
+	rec := &recorder{status: status}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		rec.paths = append(rec.paths, r.URL.Path)
+		rec.bodies = append(rec.bodies, body)
+		w.WriteHeader(rec.status)
+		io.WriteString(w, "  some error\n")
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	rec := newRecorder(t, http.StatusOK)
+	n := &webhookNotifier{client: rec.Client(), url: rec.URL + "/hook"}
+	err := n.Notify(context.Background(), models.User{Email: "bob@example.com"}, testAnnounces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.bodies) != 1 {
+		t.Fatalf("got %d requests, want 1", len(rec.bodies))
+	}
+	var payload struct {
+		Email     string
+		Announces []webhookAnnounce
+	}
+	err = json.Unmarshal(rec.bodies[0], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Email != "bob@example.com" || len(payload.Announces) != 2 {
+		t.Fatalf("got %s", rec.bodies[0])
+	}
+	got := payload.Announces[0]
+	want := webhookAnnounce{testAnnounces[0].URL, testAnnounces[0].Title, "500 €", testAnnounces[0].Date, true}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if strings.Contains(string(rec.bodies[0]), `"price":""`) {
+		t.Errorf("empty price is not omitted in %s", rec.bodies[0])
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	rec := newRecorder(t, http.StatusOK)
+	n := &slackNotifier{client: rec.Client(), url: rec.URL}
+	err := n.Notify(context.Background(), models.User{}, testAnnounces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload struct{ Text string }
+	err = json.Unmarshal(rec.bodies[0], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2 new announces from leboncoin.fr\n" +
+		"<http://www.leboncoin.fr/colocations/1.htm|Chambre &lt;meublée&gt; &amp; calme> 500 €\n" +
+		"<http://www.leboncoin.fr/colocations/2.htm|Colocation>"
+	if payload.Text != want {
+		t.Errorf("got %q, want %q", payload.Text, want)
+	}
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	rec := newRecorder(t, http.StatusOK)
+	n := &telegramNotifier{client: rec.Client(), apiURL: rec.URL, token: "123:secret", chatID: "@channel"}
+	err := n.Notify(context.Background(), models.User{}, testAnnounces[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.paths[0] != "/bot123:secret/sendMessage" {
+		t.Errorf("got path %q", rec.paths[0])
+	}
+	var payload struct {
+		ChatID string `json:"chat_id"`
+		Text   string
+	}
+	err = json.Unmarshal(rec.bodies[0], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1 new announce from leboncoin.fr\n\nChambre <meublée> & calme - 500 €\nhttp://www.leboncoin.fr/colocations/1.htm"
+	if payload.ChatID != "@channel" || payload.Text != want {
+		t.Errorf("got %+v", payload)
+	}
+}
+
+func TestTelegramNotifierHidesToken(t *testing.T) {
+	// The errors of the client contain the URL.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	n := &telegramNotifier{client: closed.Client(), apiURL: closed.URL, token: "123:secret", chatID: "1"}
+	err := n.Notify(context.Background(), models.User{}, testAnnounces)
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q leaks the token", err)
+	}
+}
+
+func TestPostJSONStatus(t *testing.T) {
+	rec := newRecorder(t, http.StatusBadGateway)
+	err := postJSON(context.Background(), rec.Client(), rec.URL, struct{}{})
+	if err == nil || err.Error() != "postJSON: 502 Bad Gateway: some error" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestPublicClientRefusesPrivateAddresses(t *testing.T) {
+	rec := newRecorder(t, http.StatusOK)
+	for _, n := range []Notifier{
+		&webhookNotifier{client: publicClient, url: rec.URL},
+		&slackNotifier{client: publicClient, url: rec.URL},
+	} {
+		err := n.Notify(context.Background(), models.User{}, testAnnounces)
+		if !errors.Is(err, errPrivateAddress) {
+			t.Errorf("%T: got error %v, want %v", n, err, errPrivateAddress)
+		}
+	}
+	if len(rec.bodies) != 0 {
+		t.Errorf("the server received %d requests", len(rec.bodies))
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tt := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	} {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %t, want %t", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestValidateChannel(t *testing.T) {
+	a := newTestApp(t)
+	a.cfg.TelegramBotToken = "123:secret"
+	for _, tt := range []struct {
+		ch models.Channel
+		ok bool
+	}{
+		{models.Channel{Kind: models.ChannelEmail, Target: "bob@example.com"}, true},
+		{models.Channel{Kind: models.ChannelEmail, Target: "bob"}, false},
+		{models.Channel{Kind: models.ChannelWebhook, Target: "https://example.com/hook"}, true},
+		{models.Channel{Kind: models.ChannelWebhook, Target: "ftp://example.com/hook"}, false},
+		{models.Channel{Kind: models.ChannelWebhook, Target: "http://localhost:8080/"}, false},
+		{models.Channel{Kind: models.ChannelWebhook, Target: "http://169.254.169.254/latest/meta-data"}, false},
+		{models.Channel{Kind: models.ChannelSlack, Target: "http://[::1]/"}, false},
+		{models.Channel{Kind: models.ChannelSlack, Target: "https://hooks.slack.com/services/T/B/X"}, true},
+		{models.Channel{Kind: models.ChannelTelegram, Target: "-1001234"}, true},
+		{models.Channel{Kind: models.ChannelTelegram, Target: "@channel"}, true},
+		{models.Channel{Kind: models.ChannelTelegram, Target: "channel"}, false},
+		{models.Channel{Kind: "pigeon", Target: "x"}, false},
+	} {
+		err := a.validateChannel(tt.ch)
+		if (err == nil) != tt.ok {
+			t.Errorf("validateChannel(%+v) = %v", tt.ch, err)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,12 +14,43 @@ import (
 	"github.com/yansal/pollbc/models"
 )
 
-func fetch() (*html.Node, error) {
-	r, err := http.Get("http://www.leboncoin.fr/colocations/offres/ile_de_france")
+// sourceName is the name of the source_url setting, which is polled when
+// there are no sources in the database.
+const sourceName = "leboncoin"
+
+// sources returns the sources to poll.
+func (a *app) sources(ctx context.Context) ([]models.Source, error) {
+	srcs, err := models.SelectSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(srcs) == 0 {
+		srcs = []models.Source{{Name: sourceName, URL: a.cfg.SourceURL}}
+	}
+	return srcs, nil
+}
+
+// fetch fetches the page of src with client.
+func fetch(ctx context.Context, client *http.Client, src models.Source) (*html.Node, error) {
+	start := time.Now()
+	status := "error"
+	defer func() {
+		fetchDuration.Observe(time.Since(start).Seconds(), src.Name, status)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Body.Close()
+	status = strconv.Itoa(r.StatusCode)
+	if r.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("fetch: %s", r.Status)
+	}
 	contentType := r.Header.Get("Content-Type")
 	reader, err := charset.NewReader(r.Body, contentType)
 	if err != nil {
@@ -49,9 +80,6 @@ func queryAnnounces(doc *html.Node) []*html.Node {
 		}
 	}
 	f(doc)
-	if len(nodes) == 0 {
-		log.Print("queryAnnounces: len(nodes) == 0")
-	}
 	return nodes
 }
 
@@ -64,7 +92,8 @@ func queryURL(n *html.Node) (string, error) {
 	return "", errors.New("Can't find href in html node")
 }
 
-func queryDate(n *html.Node) (time.Time, error) {
+// queryDate parses the date of n, which is written in loc.
+func queryDate(n *html.Node, loc *time.Location) (time.Time, error) {
 	var dateNode *html.Node
 	var f func(*html.Node)
 	count := 0
@@ -93,7 +122,7 @@ func queryDate(n *html.Node) (time.Time, error) {
 	date := split[0]
 	clock := split[1]
 
-	now := time.Now().In(paris)
+	now := time.Now().In(loc)
 	var y, d int
 	var mon time.Month
 	switch date {
@@ -139,7 +168,7 @@ func queryDate(n *html.Node) (time.Time, error) {
 		}
 
 		thisYear, _, _ := now.Date()
-		if time.Date(thisYear, mon, d, 0, 0, 0, 0, time.Local).Before(now) {
+		if time.Date(thisYear, mon, d, 0, 0, 0, 0, loc).Before(now) {
 			y = thisYear
 		} else {
 			y = thisYear - 1
@@ -156,7 +185,7 @@ func queryDate(n *html.Node) (time.Time, error) {
 		return time.Time{}, err
 	}
 
-	return time.Date(y, mon, d, h, min, 0, 0, time.Local), nil
+	return time.Date(y, mon, d, h, min, 0, 0, loc), nil
 }
 
 func queryPlace(n *html.Node) (models.Place, models.Department, error) {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+func TestFetchStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html><body>Service unavailable</body></html>", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	_, err := fetch(context.Background(), http.DefaultClient, models.Source{Name: "test", URL: srv.URL})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, want a 503 error", err)
+	}
+}
+
+func TestFetchAnnouncesEmptyPage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body><p>Nothing here</p></body></html>")
+	}))
+	defer srv.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := newTestApp(t).fetchAnnounces(context.Background(), logger, models.Source{Name: "test", URL: srv.URL})
+	if !errors.Is(err, errNoAnnounces) {
+		t.Errorf("got error %v, want %v", err, errNoAnnounces)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	_, err := fetch(context.Background(), client, models.Source{Name: "test", URL: srv.URL})
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yansal/pollbc/models"
+	"github.com/yansal/pollbc/rentcontrol"
+)
+
+var rentControl *rentcontrol.Table
+
+// setupRentControl loads the table of rent caps, which must be the one of
+// the encadrement des loyers. No rent is checked if there is no file: the
+// caps can't be guessed.
+func setupRentControl(file string) error {
+	rentControl = nil
+	if file == "" {
+		slog.Warn("no rent cap available: rent_control_file is not set, rents are not checked")
+		return nil
+	}
+	var err error
+	rentControl, err = rentcontrol.Load(file)
+	if err != nil {
+		return fmt.Errorf("no rent cap available: %w", err)
+	}
+	return nil
+}
+
+// checkRentControl sets the surface and rent cap of ann, if it is in Paris
+// and its title tells its surface. The price of an announce includes the
+// charges unless its title tells otherwise: its rent, which is compared to
+// the cap, is set only when the title tells that the price excludes the
+// charges or how much they are. The announces of colocations are priced per
+// tenant: they are checked against the share of the cap of one tenant when
+// their title tells the number of tenants, and not at all otherwise.
+func checkRentControl(ann *models.Announce, place models.Place, dpt models.Department) {
+	if rentControl == nil || dpt.Name != "Paris" {
+		return
+	}
+	l := rentcontrol.ParseTitle(ann.Title)
+	if l.Surface == 0 {
+		return
+	}
+	if strings.Contains(ann.URL, "/colocations/") {
+		if l.Tenants < 2 {
+			return
+		}
+		l.Surface /= float64(l.Tenants)
+	}
+	l.Arrondissement = leadingInt(place.Arrondissement)
+	l.Quartier = rentControl.Quartier(l.Arrondissement, ann.Title)
+	maxRent, ok := rentControl.MaxRent(l)
+	if !ok {
+		return
+	}
+	ann.Surface = int(l.Surface + 0.5)
+	ann.RentCap = int(maxRent*l.Surface + 0.5)
+	switch charges := int(l.Charges + 0.5); {
+	case l.ChargesExcluded:
+		ann.Rent = ann.PriceValue
+	case charges > 0 && charges < ann.PriceValue:
+		ann.Rent = ann.PriceValue - charges
+	}
+}
+
+// leadingInt returns the number s starts with, such as 11 for "11ème", or 0.
+func leadingInt(s string) int {
+	for i, r := range s {
+		if !unicode.IsDigit(r) {
+			s = s[:i]
+			break
+		}
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
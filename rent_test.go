@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yansal/pollbc/models"
+)
+
+func TestCheckRentControl(t *testing.T) {
+	err := setupRentControl("rentcontrol/testdata/official.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { rentControl = nil }()
+	paris := models.Department{Name: "Paris"}
+	place := models.Place{City: "Paris", Arrondissement: "11ème"}
+	for _, tt := range []struct {
+		url, title             string
+		price                  int
+		dpt                    models.Department
+		surface, rentCap, rent int
+	}{
+		// The caps are the reference rows of 2024 times the surface.
+		// Folie-Méricourt, 1 room, before 1946, furnished: 37.2 €/m².
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio meublé 20 m² Folie-Méricourt, immeuble ancien, hors charges",
+			800, paris, 20, 744, 800},
+		// Folie-Méricourt, 1 room, before 1946, unfurnished: 32.4 €/m².
+		// The charges included in the price are unknown.
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio non meublé 20 m² Folie-Méricourt haussmannien",
+			700, paris, 20, 648, 0},
+		// Roquette, 2 rooms, 1946-1970, furnished: 34.8 €/m².
+		{"http://www.leboncoin.fr/locations/1.htm", "T2 meublé 40 m² Roquette années 60, dont 100 € de charges",
+			1500, paris, 40, 1392, 1400},
+		// Sainte-Marguerite, 1 room, 1971-1990, unfurnished: 28.8 €/m².
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio non meublé 25 m² Sainte-Marguerite années 80 HC",
+			700, paris, 25, 720, 700},
+		// The highest cap of the arrondissement, Roquette's 38.4 €/m².
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio 20 m²", 900, paris, 20, 768, 0},
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio 20 m² HC", 900, models.Department{Name: "Hauts-de-Seine"}, 0, 0, 0},
+		{"http://www.leboncoin.fr/locations/1.htm", "Studio HC", 900, paris, 0, 0, 0},
+		// Colocations are checked against the share of one tenant.
+		{"http://www.leboncoin.fr/colocations/1.htm", "Colocation à 3, 60 m² hors charges", 600, paris, 20, 768, 600},
+		{"http://www.leboncoin.fr/colocations/1.htm", "Chambre dans 60 m²", 600, paris, 0, 0, 0},
+	} {
+		ann := models.Announce{URL: tt.url, Title: tt.title, PriceValue: tt.price}
+		checkRentControl(&ann, place, tt.dpt)
+		if ann.Surface != tt.surface || ann.RentCap != tt.rentCap || ann.Rent != tt.rent {
+			t.Errorf("%s %q: got %d m² capped at %d € for a rent of %d €, want %d m² at %d € for %d €",
+				tt.url, tt.title, ann.Surface, ann.RentCap, ann.Rent, tt.surface, tt.rentCap, tt.rent)
+		}
+	}
+}
+
+func TestRentExcess(t *testing.T) {
+	for _, tt := range []struct {
+		ann  models.Announce
+		want int
+	}{
+		{models.Announce{PriceValue: 800, RentCap: 744, Rent: 800}, 56},
+		{models.Announce{PriceValue: 800, RentCap: 744, Rent: 700}, 0},
+		// The price includes unknown charges.
+		{models.Announce{PriceValue: 800, RentCap: 744}, 0},
+	} {
+		if got := tt.ann.RentExcess(); got != tt.want {
+			t.Errorf("%+v: got %d, want %d", tt.ann, got, tt.want)
+		}
+	}
+}
+
+func TestSetupRentControl(t *testing.T) {
+	defer func() { rentControl = nil }()
+	err := setupRentControl("")
+	if err != nil || rentControl != nil {
+		t.Errorf("got %v, %v, want no table and no error without a file", rentControl, err)
+	}
+	err = setupRentControl("rentcontrol/testdata/missing.csv")
+	if err == nil || !strings.Contains(err.Error(), "no rent cap available") || rentControl != nil {
+		t.Errorf("got %v, %v, want no table and an error for a missing file", rentControl, err)
+	}
+}
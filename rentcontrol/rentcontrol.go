@@ -0,0 +1,420 @@
+// Package rentcontrol checks rents against the maximum rents of the
+// encadrement des loyers in Paris.
+package rentcontrol
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Construction periods.
+const (
+	PeriodBefore1946 = "avant 1946"
+	Period1946To1970 = "1946-1970"
+	Period1971To1990 = "1971-1990"
+	PeriodAfter1990  = "apres 1990"
+)
+
+// Furnished statuses.
+const (
+	Furnished   = "meuble"
+	Unfurnished = "non meuble"
+)
+
+// A Listing is what an announce tells about a rental. Zero fields are
+// unknown.
+type Listing struct {
+	Arrondissement int
+	Quartier       string
+	// Surface is in square meters.
+	Surface float64
+	// Rooms is the number of main rooms; tables have a single row for 4
+	// rooms and more.
+	Rooms     int
+	Period    string
+	Furnished string
+	// Tenants is the number of tenants sharing a colocation.
+	Tenants int
+	// ChargesExcluded is true if the price excludes the charges. Charges
+	// is the monthly amount of the charges included in the price, in euros.
+	ChargesExcluded bool
+	Charges         float64
+}
+
+type row struct {
+	arrondissement int
+	quartier       string
+	rooms          int // 0 matches any number of rooms.
+	period         string
+	furnished      string
+	maxRent        float64
+}
+
+// A Table holds maximum rents per square meter.
+type Table struct {
+	rows []row
+}
+
+// Load reads a table from a CSV file, in one of two formats.
+//
+// The first one has a header and the columns arrondissement, quartier,
+// rooms, period, furnished and max_rent_m2. Lines starting with # are
+// comments. An empty quartier and a * in the other columns match any value.
+//
+// The second one is the export of the logement-encadrement-des-loyers
+// dataset of opendata.paris.fr, separated by semicolons, with its field
+// names or its labels as header. Only the rows of the latest year are kept.
+func Load(filename string) (*Table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var t *Table
+	if official(br) {
+		t, err = loadOfficial(br)
+	} else {
+		t, err = load(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(t.rows) == 0 {
+		return nil, fmt.Errorf("rentcontrol: no rows in %s", filename)
+	}
+	return t, nil
+}
+
+// official tells whether the first line that isn't a comment is separated
+// by semicolons.
+func official(br *bufio.Reader) bool {
+	for n := 64; ; n *= 2 {
+		b, err := br.Peek(n)
+		lines := strings.Split(string(b), "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			if i < len(lines)-1 || err != nil {
+				return strings.Contains(line, ";")
+			}
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func load(r io.Reader) (*Table, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 6
+	t := new(Table)
+	header := true
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if header {
+			header = false
+			continue
+		}
+		var rw row
+		rw.arrondissement, err = strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("rentcontrol: invalid arrondissement %q", record[0])
+		}
+		rw.quartier = record[1]
+		if record[2] != "*" {
+			rw.rooms, err = strconv.Atoi(record[2])
+			if err != nil || rw.rooms < 1 {
+				return nil, fmt.Errorf("rentcontrol: invalid rooms %q", record[2])
+			}
+		}
+		rw.period, rw.furnished = record[3], record[4]
+		rw.maxRent, err = strconv.ParseFloat(record[5], 64)
+		if err != nil {
+			return nil, fmt.Errorf("rentcontrol: invalid max_rent_m2 %q", record[5])
+		}
+		t.rows = append(t.rows, rw)
+	}
+	return t, nil
+}
+
+// officialColumns are the field names and the labels of the columns of the
+// dataset of opendata.paris.fr that Load reads.
+var officialColumns = map[string][]string{
+	"quartier":  {"id_quartier", "numero du quartier"},
+	"name":      {"nom_quartier", "nom du quartier"},
+	"rooms":     {"piece", "nombre de pieces principales"},
+	"period":    {"epoque", "epoque de construction"},
+	"furnished": {"meuble_txt", "type de location"},
+	"max":       {"max", "loyers de reference majores"},
+	"year":      {"annee"},
+}
+
+func loadOfficial(r io.Reader) (*Table, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = ';'
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for i, name := range header {
+		name = normalize(strings.TrimPrefix(name, "\ufeff"))
+		for col, names := range officialColumns {
+			for _, n := range names {
+				if name == n {
+					index[col] = i
+				}
+			}
+		}
+	}
+	for col, names := range officialColumns {
+		if _, ok := index[col]; !ok && col != "year" {
+			return nil, fmt.Errorf("rentcontrol: no column %s", names[0])
+		}
+	}
+
+	t := new(Table)
+	year := ""
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < len(header) {
+			return nil, fmt.Errorf("rentcontrol: %d fields instead of %d", len(record), len(header))
+		}
+		if i, ok := index["year"]; ok {
+			switch y := record[i]; {
+			case y < year:
+				continue
+			case y > year:
+				// Years have 4 digits: keep the latest one only.
+				year = y
+				t.rows = nil
+			}
+		}
+		var rw row
+		quartier, err := strconv.Atoi(record[index["quartier"]])
+		if err != nil || quartier < 1 || quartier > 80 {
+			return nil, fmt.Errorf("rentcontrol: invalid quartier number %q", record[index["quartier"]])
+		}
+		// Quartiers are numbered 4 by 4 in the order of the
+		// arrondissements.
+		rw.arrondissement = (quartier-1)/4 + 1
+		rw.quartier = record[index["name"]]
+		rw.rooms, err = strconv.Atoi(record[index["rooms"]])
+		if err != nil || rw.rooms < 1 {
+			return nil, fmt.Errorf("rentcontrol: invalid rooms %q", record[index["rooms"]])
+		}
+		rw.period = normalize(record[index["period"]])
+		switch rw.period {
+		case PeriodBefore1946, Period1946To1970, Period1971To1990, PeriodAfter1990:
+		default:
+			return nil, fmt.Errorf("rentcontrol: invalid period %q", record[index["period"]])
+		}
+		rw.furnished = normalize(record[index["furnished"]])
+		if rw.furnished != Furnished && rw.furnished != Unfurnished {
+			return nil, fmt.Errorf("rentcontrol: invalid furnished status %q", record[index["furnished"]])
+		}
+		rw.maxRent, err = strconv.ParseFloat(strings.Replace(record[index["max"]], ",", ".", 1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("rentcontrol: invalid max rent %q", record[index["max"]])
+		}
+		t.rows = append(t.rows, rw)
+	}
+	return t, nil
+}
+
+// normalize returns s in lower case, without accents and with single
+// spaces.
+func normalize(s string) string {
+	s = strings.NewReplacer(
+		"à", "a", "â", "a", "ç", "c", "é", "e", "è", "e", "ê", "e", "ë", "e",
+		"î", "i", "ï", "i", "ô", "o", "ù", "u", "û", "u", "ü", "u",
+	).Replace(strings.ToLower(s))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ambiguousQuartiers are names of quartiers that are common words. They are
+// found in a text only after the word quartier.
+var ambiguousQuartiers = map[string]bool{
+	"gare": true, "mail": true, "europe": true, "combat": true,
+	"amerique": true, "archives": true, "monnaie": true, "chapelle": true,
+}
+
+// Quartier returns the quartier of the arrondissement that text names, or
+// "" if it names none or more than one.
+func (t *Table) Quartier(arrondissement int, text string) string {
+	text = " " + wordsOf(text) + " "
+	found := ""
+	for _, rw := range t.rows {
+		if rw.arrondissement != arrondissement || rw.quartier == "" || rw.quartier == found {
+			continue
+		}
+		name := wordsOf(rw.quartier)
+		if ambiguousQuartiers[name] {
+			name = "quartier " + name
+		}
+		if !strings.Contains(text, " "+name+" ") {
+			continue
+		}
+		if found != "" {
+			return ""
+		}
+		found = rw.quartier
+	}
+	return found
+}
+
+// wordsOf returns the normalized words of s, separated by single spaces.
+func wordsOf(s string) string {
+	return strings.Join(strings.FieldsFunc(normalize(s), func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	}), " ")
+}
+
+// MaxRent returns the maximum rent per square meter of l. As unknown
+// fields of l match any row, it is the highest maximum rent that l could
+// have. It returns false if no row matches.
+func (t *Table) MaxRent(l Listing) (float64, bool) {
+	rooms := l.Rooms
+	if rooms > 4 {
+		rooms = 4
+	}
+	max, ok := 0.0, false
+	for _, rw := range t.rows {
+		if rw.arrondissement != l.Arrondissement ||
+			!matchString(rw.quartier, "", l.Quartier) ||
+			rw.rooms != 0 && rooms != 0 && rw.rooms != rooms ||
+			!matchString(rw.period, "*", l.Period) ||
+			!matchString(rw.furnished, "*", l.Furnished) {
+			continue
+		}
+		if !ok || rw.maxRent > max {
+			max, ok = rw.maxRent, true
+		}
+	}
+	return max, ok
+}
+
+func matchString(field, any, value string) bool {
+	return field == any || value == "" || field == value
+}
+
+var (
+	surfaceRegexp = regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*(?:m²|m2\b)`)
+	roomsRegexps  = []*regexp.Regexp{
+		regexp.MustCompile(`\b[tf]([1-9])\b`),
+		regexp.MustCompile(`\b([1-9])\s*pi[eè]ces?\b`),
+	}
+	tenantsRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`\bcoloc(?:ation)?\s*(?:à|a|de|pour)\s*([2-9])\b`),
+		regexp.MustCompile(`\b([2-9])\s*colocataires\b`),
+	}
+	furnishedRegexp       = regexp.MustCompile(`\bmeubl`)
+	unfurnishedRegexp     = regexp.MustCompile(`\bnon[ -]meubl`)
+	decadeRegexp          = regexp.MustCompile(`\bann[ée]es\s*(?:19)?([2-9]0)\b`)
+	chargesExcludedRegexp = regexp.MustCompile(`\b(?:hors charges|hc)\b`)
+	chargesRegexps        = []*regexp.Regexp{
+		regexp.MustCompile(`(\d+(?:[.,]\d+)?)\s*(?:€|euros?)\s*(?:de\s+)?charges\b`),
+		regexp.MustCompile(`\bcharges\s*:?\s*(\d+(?:[.,]\d+)?)\s*(?:€|euros?)`),
+	}
+)
+
+// ParseTitle returns what the title of an announce tells about the
+// surface, number of rooms, construction period, furnished status, number
+// of tenants and charges of a rental.
+func ParseTitle(title string) Listing {
+	var l Listing
+	title = strings.ToLower(title)
+	if m := surfaceRegexp.FindStringSubmatch(title); m != nil {
+		surface, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+		// Ignore what can't be the surface of a home.
+		if err == nil && surface >= 5 && surface <= 500 {
+			l.Surface = surface
+		}
+	}
+	for _, re := range roomsRegexps {
+		if m := re.FindStringSubmatch(title); m != nil {
+			l.Rooms, _ = strconv.Atoi(m[1])
+			break
+		}
+	}
+	if l.Rooms == 0 && strings.Contains(title, "studio") {
+		l.Rooms = 1
+	}
+	switch {
+	case unfurnishedRegexp.MatchString(title):
+		l.Furnished = Unfurnished
+	case furnishedRegexp.MatchString(title):
+		// Not immeuble.
+		l.Furnished = Furnished
+	}
+	l.Period = parsePeriod(title)
+	for _, re := range tenantsRegexps {
+		if m := re.FindStringSubmatch(title); m != nil {
+			l.Tenants, _ = strconv.Atoi(m[1])
+			break
+		}
+	}
+	if chargesExcludedRegexp.MatchString(title) {
+		l.ChargesExcluded = true
+	} else {
+		for _, re := range chargesRegexps {
+			if m := re.FindStringSubmatch(title); m != nil {
+				l.Charges, _ = strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+				break
+			}
+		}
+	}
+	return l
+}
+
+// parsePeriod returns the construction period that a lower case title
+// tells, or "".
+func parsePeriod(title string) string {
+	if m := decadeRegexp.FindStringSubmatch(title); m != nil {
+		decade, _ := strconv.Atoi(m[1])
+		switch {
+		case decade < 40:
+			return PeriodBefore1946
+		case decade == 40:
+			// Both sides of 1946.
+			return ""
+		case decade < 70:
+			return Period1946To1970
+		case decade < 90:
+			return Period1971To1990
+		default:
+			return PeriodAfter1990
+		}
+	}
+	switch {
+	case strings.Contains(title, "haussmann"), strings.Contains(title, "immeuble ancien"),
+		strings.Contains(title, "pierre de taille"):
+		return PeriodBefore1946
+	case strings.Contains(title, "immeuble neuf"), strings.Contains(title, "immeuble récent"),
+		strings.Contains(title, "résidence neuve"), strings.Contains(title, "résidence récente"):
+		return PeriodAfter1990
+	}
+	return ""
+}
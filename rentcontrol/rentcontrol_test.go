@@ -0,0 +1,185 @@
+package rentcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		rows []row
+	}{
+		{"testdata/simple.csv", []row{
+			{11, "", 0, "*", Furnished, 36.5},
+			{11, "", 0, "*", Unfurnished, 32},
+			{11, "Roquette", 1, PeriodBefore1946, Furnished, 38.2},
+		}},
+		// Only the rows of 2024 are kept.
+		{"testdata/official.csv", []row{
+			{11, "Folie-Méricourt", 1, PeriodBefore1946, Furnished, 37.2},
+			{11, "Folie-Méricourt", 1, PeriodBefore1946, Unfurnished, 32.4},
+			{11, "Folie-Méricourt", 4, PeriodAfter1990, Furnished, 30},
+			{11, "Roquette", 1, PeriodBefore1946, Furnished, 38.4},
+			{11, "Roquette", 2, Period1946To1970, Furnished, 34.8},
+			{11, "Sainte-Marguerite", 1, Period1971To1990, Unfurnished, 28.8},
+		}},
+	} {
+		table, err := Load(tt.file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+		if len(table.rows) != len(tt.rows) {
+			t.Fatalf("%s: got %d rows, want %d", tt.file, len(table.rows), len(tt.rows))
+		}
+		for i := range tt.rows {
+			if table.rows[i] != tt.rows[i] {
+				t.Errorf("%s: got row %+v, want %+v", tt.file, table.rows[i], tt.rows[i])
+			}
+		}
+	}
+}
+
+func TestLoadFieldNames(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "official.csv")
+	err := os.WriteFile(file, []byte("id_zone;id_quartier;nom_quartier;piece;epoque;meuble_txt;ref;max;min;annee\n"+
+		"1;77;Belleville;3;1946-1970;non meublé;22.5;27;15.75;2024\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := row{20, "Belleville", 3, Period1946To1970, Unfurnished, 27}
+	if len(table.rows) != 1 || table.rows[0] != want {
+		t.Errorf("got %+v, want %+v", table.rows, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"arrondissement,quartier,rooms,period,furnished,max_rent_m2\n",
+		"arrondissement,quartier,rooms,period,furnished,max_rent_m2\nonze,,*,*,*,30\n",
+		"arrondissement,quartier,rooms,period,furnished,max_rent_m2\n11,,0,*,*,30\n",
+		"arrondissement,quartier,rooms,period,furnished,max_rent_m2\n11,,*,*,*,cher\n",
+		"arrondissement,quartier,rooms,period,furnished\n11,,*,*,*\n",
+		"id_quartier;nom_quartier;piece;epoque;meuble_txt\n41;Folie-Méricourt;1;Avant 1946;meublé\n",
+		"id_quartier;nom_quartier;piece;epoque;meuble_txt;max\n81;Nulle part;1;Avant 1946;meublé;30\n",
+		"id_quartier;nom_quartier;piece;epoque;meuble_txt;max\n41;Folie-Méricourt;1;1900-1910;meublé;30\n",
+		"id_quartier;nom_quartier;piece;epoque;meuble_txt;max\n41;Folie-Méricourt;1;Avant 1946;vide;30\n",
+	} {
+		file := filepath.Join(t.TempDir(), "table.csv")
+		err := os.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(file); err == nil {
+			t.Errorf("Load(%q) returned no error", content)
+		}
+	}
+	if _, err := Load("testdata/missing.csv"); err == nil {
+		t.Error("Load of a missing file returned no error")
+	}
+}
+
+func TestMaxRent(t *testing.T) {
+	table, err := Load("testdata/official.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		l   Listing
+		max float64
+		ok  bool
+	}{
+		// Unknown fields allow the highest cap.
+		{Listing{Arrondissement: 11}, 38.4, true},
+		{Listing{Arrondissement: 11, Quartier: "Folie-Méricourt"}, 37.2, true},
+		{Listing{Arrondissement: 11, Quartier: "Folie-Méricourt", Furnished: Unfurnished}, 32.4, true},
+		{Listing{Arrondissement: 11, Quartier: "Roquette", Rooms: 2}, 34.8, true},
+		{Listing{Arrondissement: 11, Period: Period1971To1990}, 28.8, true},
+		// Tables have a single row for 4 rooms and more.
+		{Listing{Arrondissement: 11, Rooms: 6}, 30, true},
+		{Listing{Arrondissement: 11, Quartier: "Roquette", Rooms: 3}, 0, false},
+		{Listing{Arrondissement: 12}, 0, false},
+	} {
+		max, ok := table.MaxRent(tt.l)
+		if max != tt.max || ok != tt.ok {
+			t.Errorf("MaxRent(%+v) = %v, %t, want %v, %t", tt.l, max, ok, tt.max, tt.ok)
+		}
+	}
+
+	// Rows with wildcards match any value.
+	table, err = Load("testdata/simple.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	max, ok := table.MaxRent(Listing{Arrondissement: 11, Quartier: "Roquette", Rooms: 3, Period: PeriodAfter1990, Furnished: Furnished})
+	if max != 36.5 || !ok {
+		t.Errorf("got %v, %t, want 36.5", max, ok)
+	}
+}
+
+func TestQuartier(t *testing.T) {
+	table, err := Load("testdata/official.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		arrondissement int
+		text, want     string
+	}{
+		{11, "Studio rue de la Roquette", "Roquette"},
+		{11, "2 pièces FOLIE MERICOURT", "Folie-Méricourt"},
+		{11, "Sainte-Marguerite, 3 pièces", "Sainte-Marguerite"},
+		// The quartier must be in the arrondissement.
+		{12, "Studio rue de la Roquette", ""},
+		// A text naming two quartiers is ambiguous.
+		{11, "Entre Roquette et Sainte-Marguerite", ""},
+		{11, "Studio Roquettes", ""},
+	} {
+		if got := table.Quartier(tt.arrondissement, tt.text); got != tt.want {
+			t.Errorf("Quartier(%d, %q) = %q, want %q", tt.arrondissement, tt.text, got, tt.want)
+		}
+	}
+
+	table.rows = append(table.rows, row{arrondissement: 13, quartier: "Gare"})
+	if got := table.Quartier(13, "Studio près de la gare"); got != "" {
+		t.Errorf("got %q for a common word", got)
+	}
+	if got := table.Quartier(13, "Studio quartier Gare"); got != "Gare" {
+		t.Errorf("got %q, want Gare", got)
+	}
+}
+
+func TestParseTitle(t *testing.T) {
+	for _, tt := range []struct {
+		title string
+		want  Listing
+	}{
+		{"Studio meublé 20 m²", Listing{Surface: 20, Rooms: 1, Furnished: Furnished}},
+		{"Appartement T3 non meublé 65,5m2", Listing{Surface: 65.5, Rooms: 3, Furnished: Unfurnished}},
+		{"3 pièces haussmannien 70 m2", Listing{Surface: 70, Rooms: 3, Period: PeriodBefore1946}},
+		{"F2 dans immeuble des années 60", Listing{Rooms: 2, Period: Period1946To1970}},
+		{"Résidence récente, 2 pièces", Listing{Rooms: 2, Period: PeriodAfter1990}},
+		{"Colocation à 3 - 80m² meublé", Listing{Surface: 80, Furnished: Furnished, Tenants: 3}},
+		{"Chambre dans un appartement de 4 colocataires", Listing{Tenants: 4}},
+		{"Studio 20 m² hors charges", Listing{Surface: 20, Rooms: 1, ChargesExcluded: true}},
+		{"Studio 800 € HC", Listing{Rooms: 1, ChargesExcluded: true}},
+		{"T2 45m2 dont 60 € de charges", Listing{Surface: 45, Rooms: 2, Charges: 60}},
+		{"T2 - charges : 45,5 euros", Listing{Rooms: 2, Charges: 45.5}},
+		{"Studio charges comprises", Listing{Rooms: 1}},
+		// Refurbished isn't built after 1990.
+		{"Chambre refaite à neuf", Listing{}},
+		// Too small or too large to be a surface.
+		{"Chambre 2 m2", Listing{}},
+		{"Loft 1000 m2", Listing{}},
+	} {
+		if got := ParseTitle(tt.title); got != tt.want {
+			t.Errorf("ParseTitle(%q) = %+v, want %+v", tt.title, got, tt.want)
+		}
+	}
+}
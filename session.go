@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+const (
+	loginTokenTTL = 15 * time.Minute
+	sessionTTL    = 30 * 24 * time.Hour
+	sessionCookie = "session"
+)
+
+type userKey struct{}
+
+// withUser makes the user of the session cookie, if any, available to h
+// through currentUser.
+func (a *app) withUser(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(sessionCookie)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		userPK, _, err := a.verifyToken("session", c.Value)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, err := models.SelectUserWherePK(r.Context(), userPK)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				logRequestError(r, err)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+func currentUser(r *http.Request) (models.User, bool) {
+	user, ok := r.Context().Value(userKey{}).(models.User)
+	return user, ok
+}
+
+func (a *app) serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		t := template.Must(template.ParseFiles("template.login.html"))
+		err := t.Execute(w, nil)
+		if err != nil {
+			logRequestError(r, err)
+		}
+		return
+	}
+
+	addr, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		renderMessage(w, http.StatusBadRequest, "Invalid email", "Please go back and enter a valid email address.")
+		return
+	}
+	user, err := models.SelectUserWhereEmail(r.Context(), addr.Address)
+	if err == nil {
+		err = a.sendLoginLink(r.Context(), user)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// Don't tell whether the email is known.
+	renderMessage(w, http.StatusOK, "Check your mailbox", "If "+addr.Address+" is subscribed, we sent it a login link.")
+}
+
+func (a *app) sendLoginLink(ctx context.Context, user models.User) error {
+	data := struct {
+		User     models.User
+		LoginURL string
+	}{user, a.tokenURL("/login/confirm", a.signToken("login", user.PK, 0, time.Now().Add(loginTokenTTL)))}
+	return a.sendMail(ctx, user.Email, "template.login.txt", data)
+}
+
+func (a *app) serveLoginConfirm(w http.ResponseWriter, r *http.Request) {
+	userPK, _, err := a.verifyToken("login", r.FormValue("token"))
+	if err != nil {
+		renderMessage(w, http.StatusBadRequest, "Invalid link", "This login link is invalid or has expired.")
+		return
+	}
+	expires := time.Now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    a.signToken("session", userPK, 0, expires),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(a.cfg.BaseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func serveLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
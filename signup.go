@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+const confirmTokenTTL = 48 * time.Hour
+
+type departmentPlaces struct {
+	Department models.Department
+	Places     []models.Place
+}
+
+// selectDepartmentPlaces returns all places grouped by department, sorted
+// the same way as on the index page.
+func selectDepartmentPlaces(ctx context.Context) ([]departmentPlaces, error) {
+	departments, err := models.SelectDepartments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(models.ByName(departments))
+	var groups []departmentPlaces
+	for _, dpt := range departments {
+		places, err := models.SelectPlacesWhereDepartmentPK(ctx, dpt.PK)
+		if err != nil {
+			return nil, err
+		}
+		if len(places) == 0 {
+			continue
+		}
+		if places[0].City != "" {
+			sort.Sort(models.ByCity(places))
+		} else {
+			sort.Sort(models.ByArrondissement(places))
+		}
+		groups = append(groups, departmentPlaces{dpt, places})
+	}
+	return groups, nil
+}
+
+func (a *app) serveSignup(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		a.postSignup(w, r)
+		return
+	}
+	groups, err := selectDepartmentPlaces(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	regions, err := models.SelectRegions(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Regions []models.Region
+		Groups  []departmentPlaces
+	}{regions, groups}
+	t := template.Must(template.ParseFiles("template.signup.html"))
+	err = t.Execute(w, data)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+func (a *app) postSignup(w http.ResponseWriter, r *http.Request) {
+	addr, err := mail.ParseAddress(r.FormValue("email"))
+	if err != nil {
+		renderMessage(w, http.StatusBadRequest, "Invalid email", "Please go back and enter a valid email address.")
+		return
+	}
+	var subs models.Subscriptions
+	subs.PlacePKs, err = parseInts(r.Form["placePK"])
+	if err == nil {
+		subs.DepartmentPKs, err = parseInts(r.Form["departmentPK"])
+	}
+	if err == nil {
+		subs.RegionPKs, err = parseInts(r.Form["regionPK"])
+	}
+	if err != nil {
+		renderMessage(w, http.StatusBadRequest, "Invalid place", "Please go back and pick places from the list.")
+		return
+	}
+	if subs.Empty() {
+		renderMessage(w, http.StatusBadRequest, "No place", "Please go back and pick at least one place.")
+		return
+	}
+
+	user, err := models.SelectUserWhereEmail(r.Context(), addr.Address)
+	if err == sql.ErrNoRows {
+		user = models.User{Email: addr.Address}
+		user.PK, err = models.InsertUser(r.Context(), user.Email)
+	}
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if user.Active {
+		// Changing the places of an active user requires a confirmation
+		// that we don't send here, otherwise anyone could edit them.
+		renderMessage(w, http.StatusOK, "Already subscribed", addr.Address+" is already subscribed. Log in to edit your places.")
+		return
+	}
+
+	// The subscriptions of the user are replaced once confirmed only,
+	// otherwise anyone could edit those of an unsubscribed user.
+	version, err := models.RequestSignup(r.Context(), user.PK, subs)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	err = a.sendConfirmation(r.Context(), user, version)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	renderMessage(w, http.StatusOK, "Check your mailbox", "We sent a confirmation link to "+addr.Address+".")
+}
+
+func parseInts(values []string) ([]int, error) {
+	var ints []int
+	for _, v := range values {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, i)
+	}
+	return ints, nil
+}
+
+// sendConfirmation sends the link confirming the signup of version.
+func (a *app) sendConfirmation(ctx context.Context, user models.User, version int) error {
+	data := struct {
+		User       models.User
+		ConfirmURL string
+	}{user, a.tokenURL("/confirm", a.signToken("confirm", user.PK, version, time.Now().Add(confirmTokenTTL)))}
+	return a.sendMail(ctx, user.Email, "template.confirm.txt", data)
+}
+
+func (a *app) serveConfirm(w http.ResponseWriter, r *http.Request) {
+	userPK, version, err := a.verifyToken("confirm", r.FormValue("token"))
+	if err == nil {
+		err = models.ConfirmSignup(r.Context(), userPK, version)
+	}
+	if err == errInvalidToken || err == models.ErrStaleConfirmation {
+		renderMessage(w, http.StatusBadRequest, "Invalid link", "This confirmation link is invalid or has expired.")
+		return
+	} else if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	renderMessage(w, http.StatusOK, "Subscription confirmed", "You will be notified of new announces.")
+}
+
+// serveUnsubscribe asks to confirm on GET, so that mail scanners and link
+// prefetchers don't unsubscribe anyone. The user is unsubscribed by the POST
+// of the confirmation form, or by the one-click POST of RFC 8058.
+func (a *app) serveUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	userPK, _, err := a.verifyToken("unsubscribe", token)
+	if err != nil {
+		renderMessage(w, http.StatusBadRequest, "Invalid link", "This unsubscribe link is invalid.")
+		return
+	}
+	if r.Method != "POST" {
+		t := template.Must(template.ParseFiles("template.unsubscribe.html"))
+		err := t.Execute(w, struct{ Token string }{token})
+		if err != nil {
+			logRequestError(r, err)
+		}
+		return
+	}
+	err = models.UnsubscribeUser(r.Context(), userPK)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	renderMessage(w, http.StatusOK, "Unsubscribed", "You won't receive notifications anymore.")
+}
+
+// unsubscribeURL returns a link that doesn't expire, so that the links of
+// old emails keep working.
+func (a *app) unsubscribeURL(userPK int) string {
+	return a.tokenURL("/unsubscribe", a.signToken("unsubscribe", userPK, 0, time.Time{}))
+}
+
+func (a *app) tokenURL(path, token string) string {
+	return a.cfg.BaseURL + path + "?" + url.Values{"token": {token}}.Encode()
+}
+
+func renderMessage(w http.ResponseWriter, status int, title, message string) {
+	data := struct {
+		Title   string
+		Message string
+	}{title, message}
+	t := template.Must(template.ParseFiles("template.message.html"))
+	w.WriteHeader(status)
+	err := t.Execute(w, data)
+	if err != nil {
+		slog.Error("rendering message", "err", err)
+	}
+}
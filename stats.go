@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+// statsPeriod is the period of the stats when the from parameter is
+// missing.
+const statsPeriod = 90 * 24 * time.Hour
+
+// statsFilter reads the placePK, departmentPK, from and to parameters of r.
+// Dates are days of loc, the time zone of the rollups.
+func statsFilter(r *http.Request, loc *time.Location) (models.StatsFilter, error) {
+	q := r.URL.Query()
+	f := models.StatsFilter{Location: loc}
+	var err error
+	f.PlacePKs, err = parseInts(q["placePK"])
+	if err != nil {
+		return f, err
+	}
+	f.DepartmentPKs, err = parseInts(q["departmentPK"])
+	if err != nil {
+		return f, err
+	}
+	f.From = time.Now().Add(-statsPeriod)
+	if v := q.Get("from"); v != "" {
+		f.From, err = parseDate(v, loc, false)
+		if err != nil {
+			return f, fmt.Errorf("invalid from %q", v)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		f.To, err = parseDate(v, loc, true)
+		if err != nil {
+			return f, fmt.Errorf("invalid to %q", v)
+		}
+	}
+	return f, nil
+}
+
+type marketStats struct {
+	Days        []models.DayStats
+	Departments []models.DepartmentStats
+	Places      []models.PlaceStats
+	Posting     models.PostingStats
+}
+
+// selectMarketStats returns the stats selected by f. Places are listed for
+// the selected departments and places only.
+func selectMarketStats(ctx context.Context, f models.StatsFilter) (marketStats, error) {
+	var stats marketStats
+	var err error
+	stats.Days, err = models.SelectDayStats(ctx, f)
+	if err != nil {
+		return stats, err
+	}
+	all := f
+	all.PlacePKs, all.DepartmentPKs = nil, nil
+	stats.Departments, err = models.SelectDepartmentStats(ctx, all)
+	if err != nil {
+		return stats, err
+	}
+	if len(f.PlacePKs) > 0 || len(f.DepartmentPKs) > 0 {
+		stats.Places, err = models.SelectPlaceStats(ctx, f)
+		if err != nil {
+			return stats, err
+		}
+	}
+	stats.Posting, err = models.SelectPostingStats(ctx, f)
+	return stats, err
+}
+
+type statsRow struct {
+	Label string
+	URL   template.URL
+	models.PriceStats
+	// Bar is the number of announces in percent of the largest one.
+	Bar int
+}
+
+type countRow struct {
+	Label string
+	Count int
+	Bar   int
+}
+
+func (a *app) serveStats(w http.ResponseWriter, r *http.Request) {
+	f, err := statsFilter(r, a.cfg.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := selectMarketStats(r.Context(), f)
+	if err != nil {
+		logRequestError(r, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	groups, err := selectDepartmentPlaces(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+	}
+	dptMap := make(map[int]models.Department)
+	placesMap := make(map[int]models.Place)
+	for _, g := range groups {
+		dptMap[g.Department.PK] = g.Department
+		for _, p := range g.Places {
+			placesMap[p.PK] = p
+		}
+	}
+
+	data := struct {
+		Groups      []departmentPlaces
+		Selected    map[int]bool
+		From        string
+		To          string
+		Days        []statsRow
+		Departments []statsRow
+		Places      []statsRow
+		Weekdays    []countRow
+		Hours       []countRow
+	}{Groups: groups, Selected: intSet(f.DepartmentPKs), From: f.From.In(f.Location).Format("2006-01-02")}
+	if !f.To.IsZero() {
+		data.To = f.To.In(f.Location).AddDate(0, 0, -1).Format("2006-01-02")
+	}
+	period := "&from=" + data.From
+	if data.To != "" {
+		period += "&to=" + data.To
+	}
+	for _, d := range stats.Days {
+		data.Days = append(data.Days, statsRow{Label: d.Day.Format("Mon 2 Jan 2006"), PriceStats: d.PriceStats})
+	}
+	for _, d := range stats.Departments {
+		data.Departments = append(data.Departments, statsRow{
+			Label:      dptMap[d.DepartmentPK].Name,
+			URL:        template.URL("departmentPK=" + strconv.Itoa(d.DepartmentPK) + period),
+			PriceStats: d.PriceStats,
+		})
+	}
+	for _, p := range stats.Places {
+		place := placesMap[p.PlacePK]
+		label := place.City
+		if label == "" {
+			label = dptMap[place.DepartmentPK].Name + " " + place.Arrondissement
+		}
+		data.Places = append(data.Places, statsRow{
+			Label:      label,
+			URL:        template.URL("placePK=" + strconv.Itoa(p.PlacePK) + period),
+			PriceStats: p.PriceStats,
+		})
+	}
+	for i := range stats.Posting.Weekdays {
+		// Start the week on Monday.
+		day := time.Weekday((i + 1) % 7)
+		data.Weekdays = append(data.Weekdays, countRow{Label: day.String(), Count: stats.Posting.Weekdays[day]})
+	}
+	for hour, count := range stats.Posting.Hours {
+		data.Hours = append(data.Hours, countRow{Label: fmt.Sprintf("%02d:00", hour), Count: count})
+	}
+	scaleStatsRows(data.Days)
+	scaleStatsRows(data.Departments)
+	scaleStatsRows(data.Places)
+	scaleCountRows(data.Weekdays)
+	scaleCountRows(data.Hours)
+
+	t := template.Must(template.ParseFiles("template.stats.html"))
+	err = t.Execute(w, data)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+func scaleStatsRows(rows []statsRow) {
+	max := 0
+	for _, r := range rows {
+		if r.Announces > max {
+			max = r.Announces
+		}
+	}
+	for i := range rows {
+		if max > 0 {
+			rows[i].Bar = 100 * rows[i].Announces / max
+		}
+	}
+}
+
+func scaleCountRows(rows []countRow) {
+	max := 0
+	for _, r := range rows {
+		if r.Count > max {
+			max = r.Count
+		}
+	}
+	for i := range rows {
+		if max > 0 {
+			rows[i].Bar = 100 * rows[i].Count / max
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yansal/pollbc/models"
+)
+
+const (
+	// streamReplayLimit is the number of announces queried at once, for
+	// instance when resuming a stream after a long disconnection.
+	streamReplayLimit = 100
+	streamPingPeriod  = 30 * time.Second
+)
+
+// announcesHub wakes up the streams when announces are inserted.
+var announcesHub = &hub{streams: make(map[chan struct{}]bool)}
+
+type hub struct {
+	mu      sync.Mutex
+	streams map[chan struct{}]bool
+	closed  bool
+}
+
+// subscribe returns a channel that receives a value when announces are
+// inserted. It is closed when the hub stops.
+func (h *hub) subscribe() chan struct{} {
+	c := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.closed {
+		close(c)
+	} else {
+		h.streams[c] = true
+	}
+	h.mu.Unlock()
+	return c
+}
+
+func (h *hub) unsubscribe(c chan struct{}) {
+	h.mu.Lock()
+	delete(h.streams, c)
+	h.mu.Unlock()
+}
+
+// run wakes up every stream each time pks receives a pk, and ends the
+// streams when pks is closed.
+func (h *hub) run(pks <-chan int) {
+	for range pks {
+		h.mu.Lock()
+		for c := range h.streams {
+			select {
+			case c <- struct{}{}:
+			default:
+				// The stream is already awake.
+			}
+		}
+		h.mu.Unlock()
+	}
+
+	h.mu.Lock()
+	for c := range h.streams {
+		close(c)
+		delete(h.streams, c)
+	}
+	h.closed = true
+	h.mu.Unlock()
+}
+
+// serveStream streams the announces selected by the parameters of the index
+// page as server-sent events, as they are inserted. Each event is the HTML
+// of an announce and its id is the pk of the announce. The stream starts
+// after the Last-Event-ID header, or the lastEventID parameter, or now.
+func (a *app) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	f, err := announceFilter(r, a.cfg.Location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// New announces are pushed in the order they are inserted.
+	f.Sort, f.After = models.SortInserted, nil
+	f.Limit = streamReplayLimit
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue("lastEventID")
+	}
+	if lastEventID != "" {
+		f.SincePK, err = strconv.Atoi(lastEventID)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		f.SincePK, err = models.SelectLastAnnouncePK(r.Context())
+		if err != nil {
+			logRequestError(r, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	wake := announcesHub.subscribe()
+	defer announcesHub.unsubscribe(wake)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	t := template.Must(template.ParseFiles("template.html"))
+	places := make(map[int]models.Place)
+	dpts := make(map[int]models.Department)
+	ping := time.NewTicker(streamPingPeriod)
+	defer ping.Stop()
+	for {
+		// The announces are sent by pages until one isn't full, so that
+		// none is skipped after a long disconnection.
+		for {
+			announces, err := models.SelectAnnouncesFilter(r.Context(), f)
+			if err != nil {
+				logRequestError(r, err)
+				return
+			}
+			for _, ann := range announces {
+				buf := new(bytes.Buffer)
+				err := t.ExecuteTemplate(buf, "announce", newAnnounceView(r.Context(), ann, places, dpts, a.cfg.Location))
+				if err != nil {
+					logRequestError(r, err)
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: announce\n", ann.PK)
+				for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+					fmt.Fprintf(w, "data: %s\n", line)
+				}
+				fmt.Fprint(w, "\n")
+				f.SincePK = ann.PK
+			}
+			flusher.Flush()
+			if len(announces) < f.Limit {
+				break
+			}
+		}
+
+		if !waitAnnounces(w, flusher, r, wake, ping) {
+			return
+		}
+	}
+}
+
+// waitAnnounces waits for wake, pinging the client meanwhile to keep proxies
+// from closing the idle connection. It returns false if the client is gone
+// or the server is shutting down.
+func waitAnnounces(w http.ResponseWriter, flusher http.Flusher, r *http.Request, wake <-chan struct{}, ping *time.Ticker) bool {
+	for {
+		select {
+		case <-r.Context().Done():
+			return false
+		case _, ok := <-wake:
+			return ok
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamResumes(t *testing.T) {
+	const lastPK = 250
+	date := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeDB(t)
+	fake.answer = func(query string, args []driver.NamedValue) [][]driver.Value {
+		switch {
+		case strings.Contains(query, "FROM pollbc_places"):
+			return [][]driver.Value{{int64(1), "", "11e", int64(75)}}
+		case strings.Contains(query, "FROM pollbc_departements"):
+			return [][]driver.Value{{int64(75), "Paris", int64(1)}}
+		}
+		// The announces after the pk, by pk, up to the limit.
+		since, limit := args[len(args)-2].Value.(int64), args[len(args)-1].Value.(int64)
+		var rows [][]driver.Value
+		for pk := since + 1; pk <= lastPK && int64(len(rows)) < limit; pk++ {
+			rows = append(rows, announceRow(pk, date))
+		}
+		return rows
+	}
+	a := newTestApp(t)
+	srv := httptest.NewServer(http.HandlerFunc(a.serveStream))
+
+	req, err := http.NewRequest("GET", srv.URL+"/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "20")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && len(ids) < lastPK-20 {
+		if id, ok := strings.CutPrefix(scanner.Text(), "id: "); ok {
+			pk, err := strconv.Atoi(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, pk)
+		}
+	}
+	resp.Body.Close()
+	srv.Close()
+
+	if len(ids) != lastPK-20 {
+		t.Fatalf("got %d announces, want %d", len(ids), lastPK-20)
+	}
+	for i, pk := range ids {
+		if pk != 21+i {
+			t.Fatalf("got announce %d at %d, want %d", pk, i, 21+i)
+		}
+	}
+	var pages []int64
+	for i, query := range fake.queries {
+		if strings.Contains(query, "FROM pollbc_announces") {
+			if !strings.Contains(query, "a.pk > $") || !strings.Contains(query, "ORDER BY a.pk ASC LIMIT") {
+				t.Errorf("got query %q, want the announces after a pk, by pk", query)
+			}
+			pages = append(pages, fake.args[i][len(fake.args[i])-2].Value.(int64))
+		}
+	}
+	if want := []int64{20, 120, 220}; len(pages) != len(want) || pages[0] != want[0] || pages[1] != want[1] || pages[2] != want[2] {
+		t.Errorf("got pages after %v, want %v", pages, want)
+	}
+}
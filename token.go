@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// signToken returns a token binding purpose, userPK and version until
+// expires, or forever if expires is zero. Tokens are base64url(payload) + "."
+// + base64url(HMAC-SHA256(payload)).
+func (a *app) signToken(purpose string, userPK, version int, expires time.Time) string {
+	var unix int64
+	if !expires.IsZero() {
+		unix = expires.Unix()
+	}
+	payload := purpose + "|" + strconv.Itoa(userPK) + "|" + strconv.FormatInt(unix, 10)
+	if version != 0 {
+		payload += "|" + strconv.Itoa(version)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(a.tokenMAC(payload))
+}
+
+// verifyToken returns the user pk and version of a token signed for purpose.
+// Tokens without a version, signed before versions existed, have version 0.
+func (a *app) verifyToken(purpose, token string) (userPK, version int, err error) {
+	split := strings.Split(token, ".")
+	if len(split) != 2 {
+		return 0, 0, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(split[0])
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(split[1])
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+	if !hmac.Equal(mac, a.tokenMAC(string(payload))) {
+		return 0, 0, errInvalidToken
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) < 3 || len(fields) > 4 || fields[0] != purpose {
+		return 0, 0, errInvalidToken
+	}
+	userPK, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+	if expires != 0 && time.Now().Unix() > expires {
+		return 0, 0, errInvalidToken
+	}
+	if len(fields) == 4 {
+		version, err = strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, errInvalidToken
+		}
+	}
+	return userPK, version, nil
+}
+
+func (a *app) tokenMAC(payload string) []byte {
+	h := hmac.New(sha256.New, []byte(a.cfg.SecretKey))
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	a := newTestApp(t)
+	a.cfg.SecretKey = "secret"
+	expires := time.Now().Add(time.Hour)
+	for _, tt := range []struct {
+		name    string
+		token   string
+		purpose string
+		pk      int
+		version int
+		err     error
+	}{
+		{"valid", a.signToken("confirm", 42, 3, expires), "confirm", 42, 3, nil},
+		{"no version", a.signToken("unsubscribe", 42, 0, time.Time{}), "unsubscribe", 42, 0, nil},
+		{"unversioned", signedPayload(a, "confirm|42|0"), "confirm", 42, 0, nil},
+		{"purpose", a.signToken("login", 42, 0, expires), "session", 0, 0, errInvalidToken},
+		{"expired", a.signToken("confirm", 42, 3, time.Now().Add(-time.Second)), "confirm", 0, 0, errInvalidToken},
+		{"tampered", strings.Replace(a.signToken("confirm", 42, 3, expires), ".", "x.", 1), "confirm", 0, 0, errInvalidToken},
+		{"fields", signedPayload(a, "confirm|42|0|3|1"), "confirm", 0, 0, errInvalidToken},
+	} {
+		pk, version, err := a.verifyToken(tt.purpose, tt.token)
+		if pk != tt.pk || version != tt.version || err != tt.err {
+			t.Errorf("%s: got %d, %d, %v, want %d, %d, %v", tt.name, pk, version, err, tt.pk, tt.version, tt.err)
+		}
+	}
+}
+
+func TestTokenSecretKey(t *testing.T) {
+	a, b := newTestApp(t), newTestApp(t)
+	a.cfg.SecretKey, b.cfg.SecretKey = "secret", "other"
+	_, _, err := b.verifyToken("confirm", a.signToken("confirm", 42, 3, time.Time{}))
+	if err != errInvalidToken {
+		t.Errorf("got error %v, want %v", err, errInvalidToken)
+	}
+}
+
+// signedPayload signs payload as signToken does.
+func signedPayload(a *app, payload string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(a.tokenMAC(payload))
+}